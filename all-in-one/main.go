@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"substack-idempotency/pkg/config"
+	"substack-idempotency/pkg/stack"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		slog.Info("No .env file found")
+	}
+
+	cfg, _, err := config.Load("all-in-one", os.Args[1:])
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	cfg.Log("all-in-one")
+
+	s, err := stack.New(cfg)
+	if err != nil {
+		slog.Error("Failed to start services", "error", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := s.Run(ctx); err != nil {
+		slog.Error("Services stopped", "error", err)
+		os.Exit(1)
+	}
+}
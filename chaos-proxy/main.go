@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"substack-idempotency/pkg/chaosproxy"
+	"substack-idempotency/pkg/config"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		slog.Info("No .env file found")
+	}
+
+	cfg, _, err := config.Load("chaos-proxy", os.Args[1:])
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	cfg.Log("chaos-proxy")
+
+	server, err := chaosproxy.NewServer(cfg)
+	if err != nil {
+		slog.Error("Failed to start Chaos Proxy", "error", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := server.Run(ctx); err != nil {
+		slog.Error("Chaos Proxy stopped", "error", err)
+		os.Exit(1)
+	}
+}
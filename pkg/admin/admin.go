@@ -0,0 +1,158 @@
+package admin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	Path        = "/admin/config"
+	HeaderToken = "X-Admin-Token"
+)
+
+// Settings holds the runtime settings of one service. Readers Load a
+// snapshot and use it for the whole unit of work, so a change never applies
+// halfway through a request or message. Updates are serialised, validated by
+// prepare and swapped in whole.
+type Settings[T any] struct {
+	service string
+	prepare func(*T) error
+	current atomic.Pointer[T]
+	mu      sync.Mutex
+}
+
+// NewSettings returns the settings of service starting from initial. prepare
+// validates a candidate and may fill in derived, unexported fields; it is
+// called for initial too.
+func NewSettings[T any](service string, initial T, prepare func(*T) error) (*Settings[T], error) {
+	s := &Settings[T]{service: service, prepare: prepare}
+	if err := prepare(&initial); err != nil {
+		return nil, err
+	}
+	s.current.Store(&initial)
+	return s, nil
+}
+
+func (s *Settings[T]) Load() *T {
+	return s.current.Load()
+}
+
+// Update applies a JSON object of changed fields on top of the current
+// settings and returns what changed.
+func (s *Settings[T]) Update(patch []byte) ([]Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.current.Load()
+	next := *old
+
+	decoder := json.NewDecoder(bytes.NewReader(patch))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&next); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	if err := s.prepare(&next); err != nil {
+		return nil, err
+	}
+
+	changes, err := diff(old, &next)
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(&next)
+	return changes, nil
+}
+
+type Change struct {
+	Setting string
+	Old     interface{}
+	New     interface{}
+}
+
+func diff(old interface{}, next interface{}) ([]Change, error) {
+	before, err := toMap(old)
+	if err != nil {
+		return nil, err
+	}
+	after, err := toMap(next)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for key, value := range after {
+		if !reflect.DeepEqual(before[key], value) {
+			changes = append(changes, Change{Setting: key, Old: before[key], New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Setting < changes[j].Setting })
+	return changes, nil
+}
+
+func toMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	return m, json.Unmarshal(data, &m)
+}
+
+// Register adds GET and PATCH /admin/config to mux. Every request must carry
+// token in X-Admin-Token; with no token configured the endpoint is disabled.
+// Every applied change is written to the log as an audit line.
+func Register[T any](mux *http.ServeMux, token string, settings *Settings[T]) {
+	mux.HandleFunc("GET "+Path, authorize(token, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, settings.Load())
+	}))
+
+	mux.HandleFunc("PATCH "+Path, authorize(token, func(w http.ResponseWriter, r *http.Request) {
+		var patch bytes.Buffer
+		if _, err := patch.ReadFrom(http.MaxBytesReader(w, r.Body, 64<<10)); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		changes, err := settings.Update(patch.Bytes())
+		if err != nil {
+			slog.Warn("Rejected admin config change", "service", settings.service, "remote_addr", r.RemoteAddr, "error", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		for _, c := range changes {
+			slog.Warn("Audit: admin config changed", "service", settings.service, "setting", c.Setting, "old", c.Old, "new", c.New, "remote_addr", r.RemoteAddr)
+		}
+		writeJSON(w, http.StatusOK, settings.Load())
+	}))
+}
+
+func authorize(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "Admin API is disabled, set ADMIN_TOKEN to enable it", http.StatusForbidden)
+			return
+		}
+		given := strings.TrimSpace(r.Header.Get(HeaderToken))
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,28 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Layers that can catch a duplicate, from the first one a payment passes
+// through to the last.
+const (
+	LayerBroker   = "broker"
+	LayerInbox    = "inbox"
+	LayerStrategy = "strategy"
+	LayerVendor   = "vendor"
+)
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func RecordDuplicate(ctx context.Context, db execer, orderID string, messageID string, layer string, detail string) error {
+	query := `INSERT INTO duplicate_events (order_id, message_id, layer, detail) VALUES (?, ?, ?, ?)`
+	if _, err := db.ExecContext(ctx, query, orderID, sql.NullString{String: messageID, Valid: messageID != ""}, layer, detail); err != nil {
+		return fmt.Errorf("failed to record duplicate event: %w", err)
+	}
+	return nil
+}
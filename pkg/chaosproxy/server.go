@@ -0,0 +1,174 @@
+package chaosproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/config"
+	"substack-idempotency/pkg/httpserver"
+)
+
+// duplicateTimeout bounds the copy of a duplicated request, which no client
+// is waiting for.
+const duplicateTimeout = 30 * time.Second
+
+// Server is a reverse proxy in front of external-order-fulfilment that
+// injects network faults, in the spirit of toxiproxy. Every request it does
+// not serve itself is forwarded to cfg.Vendor.URL.
+type Server struct {
+	cfg      config.Config
+	settings *admin.Settings[Settings]
+	client   *http.Client
+	listener net.Listener
+}
+
+// NewServer validates the fault rates and binds cfg.Proxy.Addr. Run releases
+// the listener on exit.
+func NewServer(cfg config.Config) (*Server, error) {
+	s := &Server{cfg: cfg, client: &http.Client{}}
+	var err error
+	s.settings, err = s.newSettings()
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy settings: %w", err)
+	}
+
+	s.listener, err = net.Listen("tcp", cfg.Proxy.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.Proxy.Addr, err)
+	}
+	return s, nil
+}
+
+// Close releases the listener NewServer opened. Run calls it on exit.
+func (s *Server) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.forward)
+	mux.HandleFunc("/health", healthCheck)
+	admin.Register(mux, s.cfg.Admin.Token, s.settings)
+
+	slog.Info("Chaos Proxy starting on "+s.listener.Addr().String(), "upstream", s.cfg.Vendor.URL)
+	return httpserver.Serve(ctx, s.listener, mux)
+}
+
+// forward sends the request upstream, rolling for each fault on the way. A
+// reset or a fake 502 never reaches the vendor; a dropped response only
+// happens after the vendor has processed the request.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request) {
+	settings := s.settings.Load()
+	attrs := []interface{}{"method", r.Method, "path", r.URL.Path}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if settings.roll(settings.ResetRate) {
+		slog.Warn("Chaos: resetting connection", attrs...)
+		closeConnection(w, true)
+		return
+	}
+
+	if settings.roll(settings.BadGatewayRate) {
+		slog.Warn("Chaos: returning fake 502", attrs...)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	if settings.roll(settings.LatencyRate) {
+		slog.Warn("Chaos: delaying request", append(attrs, "latency", settings.latency())...)
+		time.Sleep(settings.latency())
+	}
+
+	if settings.roll(settings.DuplicateRate) {
+		slog.Warn("Chaos: duplicating request", attrs...)
+		go s.sendDuplicate(r, body, attrs)
+	}
+
+	resp, err := s.send(r.Context(), r, body)
+	if err != nil {
+		slog.Error("Failed to reach upstream", append(attrs, "error", err)...)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		slog.Error("Failed to read upstream response", append(attrs, "error", err)...)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	if settings.roll(settings.DropRate) {
+		slog.Warn("Chaos: dropping response after upstream processed the request", append(attrs, "status", resp.StatusCode)...)
+		closeConnection(w, false)
+		return
+	}
+
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(respBody)
+}
+
+func (s *Server) sendDuplicate(r *http.Request, body []byte, attrs []interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), duplicateTimeout)
+	defer cancel()
+
+	resp, err := s.send(ctx, r, body)
+	if err != nil {
+		slog.Error("Duplicated request failed", append(attrs, "error", err)...)
+		return
+	}
+	resp.Body.Close()
+	slog.Info("Duplicated request answered", append(attrs, "status", resp.StatusCode)...)
+}
+
+func (s *Server) send(ctx context.Context, r *http.Request, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, r.Method, s.cfg.Vendor.URL+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Connection")
+	return s.client.Do(req)
+}
+
+// closeConnection hangs up on the client without a response. With reset the
+// connection is closed with an RST instead of a FIN.
+func closeConnection(w http.ResponseWriter, reset bool) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok && reset {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,65 @@
+package chaosproxy
+
+import (
+	"fmt"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/utils"
+)
+
+// Settings are the proxy's fault rates, in percent of requests. They can be
+// changed at runtime through /admin/config.
+type Settings struct {
+	LatencyMs      int   `json:"latency_ms"`
+	LatencyRate    int   `json:"latency_rate"`
+	DropRate       int   `json:"drop_rate"`
+	DuplicateRate  int   `json:"duplicate_rate"`
+	ResetRate      int   `json:"reset_rate"`
+	BadGatewayRate int   `json:"bad_gateway_rate"`
+	Seed           int64 `json:"seed"`
+
+	rand *utils.Rand
+}
+
+func (s Settings) latency() time.Duration {
+	return time.Duration(s.LatencyMs) * time.Millisecond
+}
+
+func (s *Server) newSettings() (*admin.Settings[Settings], error) {
+	initial := Settings{
+		LatencyMs:      int(s.cfg.Proxy.Latency.Milliseconds()),
+		LatencyRate:    s.cfg.Proxy.LatencyRate,
+		DropRate:       s.cfg.Proxy.DropRate,
+		DuplicateRate:  s.cfg.Proxy.DuplicateRate,
+		ResetRate:      s.cfg.Proxy.ResetRate,
+		BadGatewayRate: s.cfg.Proxy.BadGatewayRate,
+		Seed:           s.cfg.Random.Seed,
+	}
+	return admin.NewSettings("chaos-proxy", initial, prepareSettings)
+}
+
+func prepareSettings(settings *Settings) error {
+	if settings.LatencyMs < 0 {
+		return fmt.Errorf("latency_ms must not be negative")
+	}
+	rates := map[string]int{
+		"latency_rate":     settings.LatencyRate,
+		"drop_rate":        settings.DropRate,
+		"duplicate_rate":   settings.DuplicateRate,
+		"reset_rate":       settings.ResetRate,
+		"bad_gateway_rate": settings.BadGatewayRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 100 {
+			return fmt.Errorf("%s must be between 0 and 100, got %d", name, rate)
+		}
+	}
+	settings.rand = utils.NewRand(settings.Seed)
+	return nil
+}
+
+// roll reports whether a fault with the given rate hits this request.
+func (s Settings) roll(rate int) bool {
+	return rate > 0 && s.rand.Intn(100) < rate
+}
@@ -0,0 +1,391 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"substack-idempotency/pkg/idempotency"
+	"substack-idempotency/pkg/nats"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every setting of the services and the tooling. Each field is set
+// from, in increasing precedence: its default, the YAML file named by
+// --config or CONFIG_FILE, its env var, and its flag. The flag is the YAML
+// section and key, e.g. --order.idempotency_check=true. Durations take a Go
+// duration ("1.5s") or a plain number in the unit of the env var.
+type Config struct {
+	Database Database `yaml:"database"`
+	NATS     NATS     `yaml:"nats"`
+	Order    Order    `yaml:"order"`
+	Payment  Payment  `yaml:"payment"`
+	Vendor   Vendor   `yaml:"vendor"`
+	Proxy    Proxy    `yaml:"proxy"`
+	Admin    Admin    `yaml:"admin"`
+	Random   Random   `yaml:"random"`
+}
+
+type Database struct {
+	User     string `yaml:"user" env:"DB_USER"`
+	Password string `yaml:"password" env:"DB_PASSWORD" secret:"true"`
+	Host     string `yaml:"host" env:"DB_HOST"`
+	Port     string `yaml:"port" env:"DB_PORT"`
+	Name     string `yaml:"name" env:"DB_NAME"`
+}
+
+type NATS struct {
+	URL             string        `yaml:"url" env:"NATS_URL"`
+	Stream          string        `yaml:"stream" env:"NATS_STREAM"`
+	Durable         string        `yaml:"durable" env:"NATS_DURABLE"`
+	AckWait         time.Duration `yaml:"ack_wait" env:"NATS_ACK_WAIT_MS" unit:"ms"`
+	MaxDeliver      int           `yaml:"max_deliver" env:"NATS_MAX_DELIVER"`
+	FetchBatch      int           `yaml:"fetch_batch" env:"NATS_FETCH_BATCH"`
+	NakBackoff      time.Duration `yaml:"nak_backoff" env:"NATS_NAK_BACKOFF_MS" unit:"ms"`
+	DuplicateWindow time.Duration `yaml:"duplicate_window" env:"NATS_DUPLICATE_WINDOW_MS" unit:"ms"`
+
+	// Faults injected on every publish and delivery, see nats.Faults.
+	FaultDelay         time.Duration `yaml:"fault_delay" env:"NATS_FAULT_DELAY_MS" unit:"ms"`
+	FaultDelayRate     int           `yaml:"fault_delay_rate" env:"NATS_FAULT_DELAY_RATE"`
+	FaultReorderRate   int           `yaml:"fault_reorder_rate" env:"NATS_FAULT_REORDER_RATE"`
+	FaultDropRate      int           `yaml:"fault_drop_rate" env:"NATS_FAULT_DROP_RATE"`
+	FaultDuplicateRate int           `yaml:"fault_duplicate_rate" env:"NATS_FAULT_DUPLICATE_RATE"`
+	FaultPaused        bool          `yaml:"fault_paused" env:"NATS_FAULT_PAUSED"`
+}
+
+func (n NATS) Faults() nats.Faults {
+	return nats.Faults{
+		DelayMs:       int(n.FaultDelay.Milliseconds()),
+		DelayRate:     n.FaultDelayRate,
+		ReorderRate:   n.FaultReorderRate,
+		DropRate:      n.FaultDropRate,
+		DuplicateRate: n.FaultDuplicateRate,
+		Paused:        n.FaultPaused,
+	}
+}
+
+type Order struct {
+	Addr                string        `yaml:"addr" env:"ORDER_ADDR"`
+	URL                 string        `yaml:"url" env:"ORDER_URL"`
+	IdempotencyCheck    bool          `yaml:"idempotency_check" env:"IDEMPOTENCY_CHECK"`
+	IdempotencyStrategy string        `yaml:"idempotency_strategy" env:"IDEMPOTENCY_STRATEGY"`
+	ClaimLease          time.Duration `yaml:"claim_lease" env:"CLAIM_LEASE_MS" unit:"ms"`
+	InboxRetention      time.Duration `yaml:"inbox_retention" env:"INBOX_RETENTION_HOURS" unit:"h"`
+	RetryBase           time.Duration `yaml:"retry_base" env:"FULFILMENT_RETRY_BASE_MS" unit:"ms"`
+	RetryMax            time.Duration `yaml:"retry_max" env:"FULFILMENT_RETRY_MAX_MS" unit:"ms"`
+	MaxRetries          int           `yaml:"max_retries" env:"FULFILMENT_MAX_RETRIES"`
+	RetryPoll           time.Duration `yaml:"retry_poll" env:"FULFILMENT_RETRY_POLL_MS" unit:"ms"`
+	VendorTimeout       time.Duration `yaml:"vendor_timeout" env:"VENDOR_TIMEOUT_MS" unit:"ms"`
+	Faults              string        `yaml:"faults" env:"ORDER_FAULTS"`
+	ViaProxy            bool          `yaml:"via_proxy" env:"ORDER_VIA_PROXY"`
+}
+
+type Payment struct {
+	Addr          string        `yaml:"addr" env:"PAYMENT_ADDR"`
+	URL           string        `yaml:"url" env:"PAYMENT_URL"`
+	Timeout       time.Duration `yaml:"timeout" env:"PAYMENT_TIMEOUT_MS" unit:"ms"`
+	OutboxPoll    time.Duration `yaml:"outbox_poll" env:"OUTBOX_POLL_MS" unit:"ms"`
+	PublishDedupe bool          `yaml:"publish_dedupe" env:"PUBLISH_DEDUPE"`
+	Faults        string        `yaml:"faults" env:"PAYMENT_FAULTS"`
+}
+
+type Vendor struct {
+	Addr             string        `yaml:"addr" env:"VENDOR_ADDR"`
+	URL              string        `yaml:"url" env:"VENDOR_URL"`
+	IdempotencyCheck bool          `yaml:"idempotency_check" env:"EXTERNAL_IDEMPOTENCY_CHECK"`
+	ErrorRates       string        `yaml:"error_rates" env:"VENDOR_ERROR_RATES"`
+	RetryableReplay  time.Duration `yaml:"retryable_replay" env:"VENDOR_RETRYABLE_REPLAY_MS" unit:"ms"`
+	ProcessingLease  time.Duration `yaml:"processing_lease" env:"VENDOR_PROCESSING_LEASE_MS" unit:"ms"`
+	Faults           string        `yaml:"faults" env:"VENDOR_FAULTS"`
+}
+
+// Proxy is the chaos proxy in front of external-order-fulfilment. Rates are
+// percentages of requests.
+type Proxy struct {
+	Addr           string        `yaml:"addr" env:"PROXY_ADDR"`
+	URL            string        `yaml:"url" env:"PROXY_URL"`
+	Latency        time.Duration `yaml:"latency" env:"PROXY_LATENCY_MS" unit:"ms"`
+	LatencyRate    int           `yaml:"latency_rate" env:"PROXY_LATENCY_RATE"`
+	DropRate       int           `yaml:"drop_rate" env:"PROXY_DROP_RATE"`
+	DuplicateRate  int           `yaml:"duplicate_rate" env:"PROXY_DUPLICATE_RATE"`
+	ResetRate      int           `yaml:"reset_rate" env:"PROXY_RESET_RATE"`
+	BadGatewayRate int           `yaml:"bad_gateway_rate" env:"PROXY_BAD_GATEWAY_RATE"`
+}
+
+type Admin struct {
+	Token string `yaml:"token" env:"ADMIN_TOKEN" secret:"true"`
+}
+
+// Random seeds the random decisions of every service: the orders generated,
+// how often a payment is published, vendor errors and injected faults. 0
+// seeds from the clock.
+type Random struct {
+	Seed int64 `yaml:"seed" env:"RANDOM_SEED"`
+}
+
+func Default() Config {
+	return Config{
+		Database: Database{
+			Host: "localhost",
+			Port: "3306",
+		},
+		NATS: NATS{
+			URL:             "nats://localhost:4222",
+			Stream:          "PAYMENTS",
+			Durable:         "internal-order",
+			AckWait:         30 * time.Second,
+			MaxDeliver:      5,
+			FetchBatch:      10,
+			NakBackoff:      500 * time.Millisecond,
+			DuplicateWindow: 2 * time.Minute,
+			FaultDelay:      5 * time.Second,
+		},
+		Order: Order{
+			Addr:                ":8000",
+			URL:                 "http://localhost:8000",
+			IdempotencyStrategy: idempotency.UniqueClaim,
+			ClaimLease:          30 * time.Second,
+			InboxRetention:      168 * time.Hour,
+			RetryBase:           time.Second,
+			RetryMax:            time.Minute,
+			MaxRetries:          3,
+			RetryPoll:           time.Second,
+			VendorTimeout:       5 * time.Second,
+		},
+		Payment: Payment{
+			Addr:       ":8001",
+			URL:        "http://localhost:8001",
+			Timeout:    200 * time.Millisecond,
+			OutboxPoll: 100 * time.Millisecond,
+		},
+		Vendor: Vendor{
+			Addr:            ":9000",
+			URL:             "http://localhost:9000",
+			ErrorRates:      "INVALID_NUMBER=3,INSUFFICIENT_BALANCE=2,VENDOR_BUSY=3,OPERATOR_DOWN=2",
+			RetryableReplay: time.Second,
+			ProcessingLease: 30 * time.Second,
+		},
+		Proxy: Proxy{
+			Addr:    ":9100",
+			URL:     "http://localhost:9100",
+			Latency: time.Second,
+		},
+	}
+}
+
+// setting is one leaf field of Config with the names it is known by.
+type setting struct {
+	Key    string
+	Env    string
+	Unit   string
+	Secret bool
+	Value  reflect.Value
+}
+
+func settings(cfg *Config) []setting {
+	var all []setting
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i).Tag.Get("yaml")
+		group := root.Field(i)
+		for j := 0; j < group.NumField(); j++ {
+			field := group.Type().Field(j)
+			all = append(all, setting{
+				Key:    section + "." + field.Tag.Get("yaml"),
+				Env:    field.Tag.Get("env"),
+				Unit:   field.Tag.Get("unit"),
+				Secret: field.Tag.Get("secret") == "true",
+				Value:  group.Field(j),
+			})
+		}
+	}
+	return all
+}
+
+// Load builds the configuration of the program called name. args are the
+// command line arguments after the program name; anything that is not a
+// config flag is returned for the caller to handle.
+func Load(name string, args []string) (Config, []string, error) {
+	cfg := Default()
+	all := settings(&cfg)
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML config file")
+	overrides := make(map[string]string)
+	for _, s := range all {
+		key := s.Key
+		flags.Func(key, "overrides "+s.Env, func(value string) error {
+			overrides[key] = value
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(*configFile, all); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	// A variable that is set but empty clears a string setting, so that
+	// ORDER_FAULTS= disarms faults armed in the file. Other types have no
+	// empty value and keep what they had.
+	for _, s := range all {
+		value, ok := os.LookupEnv(s.Env)
+		if !ok || (value == "" && s.Value.Kind() != reflect.String) {
+			continue
+		}
+		if err := set(s, value); err != nil {
+			return cfg, nil, fmt.Errorf("%s: %w", s.Env, err)
+		}
+	}
+
+	for _, s := range all {
+		value, ok := overrides[s.Key]
+		if !ok {
+			continue
+		}
+		if err := set(s, value); err != nil {
+			return cfg, nil, fmt.Errorf("--%s: %w", s.Key, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, nil, err
+	}
+	return cfg, flags.Args(), nil
+}
+
+func loadFile(path string, all []setting) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var sections map[string]map[string]string
+	if err := yaml.Unmarshal(data, &sections); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	for section, values := range sections {
+		for key, value := range values {
+			i := slices.IndexFunc(all, func(s setting) bool { return s.Key == section+"."+key })
+			if i < 0 {
+				return fmt.Errorf("%s: unknown setting %s.%s", path, section, key)
+			}
+			if err := set(all[i], value); err != nil {
+				return fmt.Errorf("%s: %s: %w", path, all[i].Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// set parses value into the setting's field. Booleans must be spelled out,
+// so a typo is an error instead of silently meaning false.
+func set(s setting, value string) error {
+	value = strings.TrimSpace(value)
+	switch field := s.Value.Addr().Interface().(type) {
+	case *string:
+		*field = value
+	case *bool:
+		switch strings.ToLower(value) {
+		case "true":
+			*field = true
+		case "false":
+			*field = false
+		default:
+			return fmt.Errorf("invalid boolean %q, expected true or false", value)
+		}
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field = n
+	case *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field = n
+	case *time.Duration:
+		d, err := parseDuration(value, s.Unit)
+		if err != nil {
+			return err
+		}
+		*field = d
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return nil
+}
+
+func parseDuration(value string, unit string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		switch unit {
+		case "h":
+			return time.Duration(n) * time.Hour, nil
+		default:
+			return time.Duration(n) * time.Millisecond, nil
+		}
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Order.IdempotencyStrategy == "" || slices.Contains(idempotency.Names(), c.Order.IdempotencyStrategy),
+		"IDEMPOTENCY_STRATEGY %q is not one of %s", c.Order.IdempotencyStrategy, strings.Join(idempotency.Names(), ", "))
+	check(c.Order.ClaimLease > 0, "CLAIM_LEASE_MS must be positive")
+	check(c.Order.InboxRetention > 0, "INBOX_RETENTION_HOURS must be positive")
+	check(c.Order.RetryBase > 0, "FULFILMENT_RETRY_BASE_MS must be positive")
+	check(c.Order.RetryMax >= c.Order.RetryBase, "FULFILMENT_RETRY_MAX_MS must not be less than FULFILMENT_RETRY_BASE_MS")
+	check(c.Order.MaxRetries >= 0, "FULFILMENT_MAX_RETRIES must not be negative")
+	check(c.Order.RetryPoll > 0, "FULFILMENT_RETRY_POLL_MS must be positive")
+	check(c.Order.VendorTimeout > 0, "VENDOR_TIMEOUT_MS must be positive")
+	check(c.NATS.AckWait > 0, "NATS_ACK_WAIT_MS must be positive")
+	check(c.NATS.FetchBatch > 0, "NATS_FETCH_BATCH must be positive")
+	check(c.NATS.NakBackoff > 0, "NATS_NAK_BACKOFF_MS must be positive")
+	check(c.NATS.DuplicateWindow >= 0, "NATS_DUPLICATE_WINDOW_MS must not be negative")
+	check(c.Payment.Timeout >= 0, "PAYMENT_TIMEOUT_MS must not be negative")
+	check(c.Payment.OutboxPoll > 0, "OUTBOX_POLL_MS must be positive")
+	check(c.Vendor.RetryableReplay >= 0, "VENDOR_RETRYABLE_REPLAY_MS must not be negative")
+	check(c.Vendor.ProcessingLease > 0, "VENDOR_PROCESSING_LEASE_MS must be positive")
+
+	return errors.Join(errs...)
+}
+
+// Log writes the effective configuration as one line, with secrets masked.
+func (c Config) Log(name string) {
+	attrs := []interface{}{"program", name}
+	for _, s := range settings(&c) {
+		value := fmt.Sprint(s.Value.Interface())
+		if s.Secret && value != "" {
+			value = "***"
+		}
+		attrs = append(attrs, s.Key, value)
+	}
+	slog.Info("Effective configuration", attrs...)
+}
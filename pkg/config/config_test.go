@@ -0,0 +1,289 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every config env var for the test, so the environment the
+// tests run in does not leak into Load. t.Setenv restores them afterwards.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	cfg := Default()
+	for _, s := range settings(&cfg) {
+		t.Setenv(s.Env, "")
+		os.Unsetenv(s.Env)
+	}
+	t.Setenv("CONFIG_FILE", "")
+}
+
+func TestDefaultIdempotencyChecksOff(t *testing.T) {
+	cfg := Default()
+	if cfg.Order.IdempotencyCheck {
+		t.Error("Order.IdempotencyCheck defaults to true")
+	}
+	if cfg.Vendor.IdempotencyCheck {
+		t.Error("Vendor.IdempotencyCheck defaults to true")
+	}
+}
+
+func TestSetBool(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{value: "true", want: true},
+		{value: "false", want: false},
+		{value: "TRUE", want: true},
+		{value: " false ", want: false},
+		{value: "1", wantErr: true},
+		{value: "yes", wantErr: true},
+		{value: "ture", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cfg := Default()
+			s := findSetting(t, &cfg, "order.idempotency_check")
+
+			err := set(s, tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("set(%q) = nil, want an error", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("set(%q) = %v", tt.value, err)
+			}
+			if cfg.Order.IdempotencyCheck != tt.want {
+				t.Errorf("set(%q) gave %v, want %v", tt.value, cfg.Order.IdempotencyCheck, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetDuration(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{key: "order.claim_lease", value: "1500", want: 1500 * time.Millisecond},
+		{key: "order.claim_lease", value: "1.5s", want: 1500 * time.Millisecond},
+		{key: "order.claim_lease", value: "2m", want: 2 * time.Minute},
+		{key: "order.inbox_retention", value: "24", want: 24 * time.Hour},
+		{key: "order.inbox_retention", value: "30m", want: 30 * time.Minute},
+		{key: "order.claim_lease", value: "1.5", wantErr: true},
+		{key: "order.claim_lease", value: "soon", wantErr: true},
+		{key: "order.claim_lease", value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			cfg := Default()
+			s := findSetting(t, &cfg, tt.key)
+
+			err := set(s, tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("set(%q) = nil, want an error", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("set(%q) = %v", tt.value, err)
+			}
+			if got := s.Value.Interface().(time.Duration); got != tt.want {
+				t.Errorf("set(%q) gave %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := `order:
+  idempotency_check: true
+  claim_lease: 10s
+  faults: order.after-claim=error
+payment:
+  timeout: 300ms
+`
+
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		args  []string
+		check func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg Config) {
+				wantDuration(t, "order.claim_lease", cfg.Order.ClaimLease, 30*time.Second)
+				wantBool(t, "order.idempotency_check", cfg.Order.IdempotencyCheck, false)
+			},
+		},
+		{
+			name: "file over default",
+			file: file,
+			check: func(t *testing.T, cfg Config) {
+				wantDuration(t, "order.claim_lease", cfg.Order.ClaimLease, 10*time.Second)
+				wantDuration(t, "payment.timeout", cfg.Payment.Timeout, 300*time.Millisecond)
+				wantBool(t, "order.idempotency_check", cfg.Order.IdempotencyCheck, true)
+			},
+		},
+		{
+			name: "env over file",
+			file: file,
+			env:  map[string]string{"CLAIM_LEASE_MS": "20000", "IDEMPOTENCY_CHECK": "false"},
+			check: func(t *testing.T, cfg Config) {
+				wantDuration(t, "order.claim_lease", cfg.Order.ClaimLease, 20*time.Second)
+				wantDuration(t, "payment.timeout", cfg.Payment.Timeout, 300*time.Millisecond)
+				wantBool(t, "order.idempotency_check", cfg.Order.IdempotencyCheck, false)
+			},
+		},
+		{
+			name: "flag over env",
+			file: file,
+			env:  map[string]string{"CLAIM_LEASE_MS": "20000", "IDEMPOTENCY_CHECK": "false"},
+			args: []string{"--order.claim_lease=40s", "--order.idempotency_check=true"},
+			check: func(t *testing.T, cfg Config) {
+				wantDuration(t, "order.claim_lease", cfg.Order.ClaimLease, 40*time.Second)
+				wantBool(t, "order.idempotency_check", cfg.Order.IdempotencyCheck, true)
+			},
+		},
+		{
+			name: "empty env keeps file duration",
+			file: file,
+			env:  map[string]string{"CLAIM_LEASE_MS": ""},
+			check: func(t *testing.T, cfg Config) {
+				wantDuration(t, "order.claim_lease", cfg.Order.ClaimLease, 10*time.Second)
+			},
+		},
+		{
+			name: "empty env clears file string",
+			file: file,
+			env:  map[string]string{"ORDER_FAULTS": ""},
+			check: func(t *testing.T, cfg Config) {
+				wantString(t, "order.faults", cfg.Order.Faults, "")
+			},
+		},
+		{
+			name: "unset env keeps file string",
+			file: file,
+			check: func(t *testing.T, cfg Config) {
+				wantString(t, "order.faults", cfg.Order.Faults, "order.after-claim=error")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"--config", writeFile(t, tt.file)}, args...)
+			}
+
+			cfg, rest, err := Load("test", args)
+			if err != nil {
+				t.Fatalf("Load() = %v", err)
+			}
+			if len(rest) != 0 {
+				t.Errorf("Load() left arguments %v", rest)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{name: "bool in env", env: map[string]string{"IDEMPOTENCY_CHECK": "1"}, want: "IDEMPOTENCY_CHECK"},
+		{name: "duration in env", env: map[string]string{"CLAIM_LEASE_MS": "30 seconds"}, want: "CLAIM_LEASE_MS"},
+		{name: "bool in flag", args: []string{"--vendor.idempotency_check=on"}, want: "--vendor.idempotency_check"},
+		{name: "bool in file", file: "order:\n  via_proxy: enabled\n", want: "order.via_proxy"},
+		{name: "unknown key in file", file: "order:\n  claim_leese: 1s\n", want: "unknown setting order.claim_leese"},
+		{name: "validation", args: []string{"--order.claim_lease=0"}, want: "CLAIM_LEASE_MS must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"--config", writeFile(t, tt.file)}, args...)
+			}
+
+			_, _, err := Load("test", args)
+			if err == nil {
+				t.Fatal("Load() = nil, want an error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() = %q, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func findSetting(t *testing.T, cfg *Config, key string) setting {
+	t.Helper()
+	for _, s := range settings(cfg) {
+		if s.Key == key {
+			return s
+		}
+	}
+	t.Fatalf("no setting %s", key)
+	return setting{}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func wantDuration(t *testing.T, key string, got time.Duration, want time.Duration) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s = %v, want %v", key, got, want)
+	}
+}
+
+func wantString(t *testing.T, key string, got string, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s = %q, want %q", key, got, want)
+	}
+}
+
+func wantBool(t *testing.T, key string, got bool, want bool) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s = %v, want %v", key, got, want)
+	}
+}
@@ -2,38 +2,53 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
+	"sort"
+	"strings"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 var DB *sql.DB
 
-func Init() error {
+type Config struct {
+	User     string
+	Password string
+	Host     string
+	Port     string
+	Name     string
+}
+
+// Open returns a handle of its own, so several services can run in one
+// process without sharing the package-level DB.
+func Open(cfg Config) (*sql.DB, error) {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=Asia%%2FJakarta",
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_NAME"))
+		cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name)
 
-	var err error
-	DB, err = sql.Open("mysql", dsn)
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		return fmt.Errorf("failed to connect to database: %w", err)
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	if err := DB.Ping(); err != nil {
-		return fmt.Errorf("failed to ping database: %w", err)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	if _, err := DB.Exec("SET time_zone = '+07:00'"); err != nil {
-		return fmt.Errorf("failed to set timezone: %w", err)
+	if _, err := db.Exec("SET time_zone = '+07:00'"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set timezone: %w", err)
 	}
 
-	return nil
+	return db, nil
+}
+
+func Init(cfg Config) error {
+	var err error
+	DB, err = Open(cfg)
+	return err
 }
 
 func Close() error {
@@ -44,6 +59,10 @@ func Close() error {
 }
 
 func CreateTables() error {
+	return Migrate(DB)
+}
+
+func Migrate(db *sql.DB) error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS internal_orders (
 			id VARCHAR(255) PRIMARY KEY,
@@ -54,7 +73,33 @@ func CreateTables() error {
 			destination_phone VARCHAR(20) NOT NULL,
 			total INT NOT NULL,
 			status VARCHAR(20) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			idempotency_key VARCHAR(255) NOT NULL,
+			vendor_order_id INT NULL,
+			vendor_processed_at TIMESTAMP(3) NULL,
+			vendor_error VARCHAR(255) NULL,
+			retryable BOOLEAN NOT NULL DEFAULT FALSE,
+			retry_count INT NOT NULL DEFAULT 0,
+			next_retry_at TIMESTAMP(3) NULL,
+			run_id VARCHAR(64) NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			KEY idx_next_retry_at (next_retry_at),
+			KEY idx_run_id (run_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS simulation_runs (
+			id VARCHAR(64) PRIMARY KEY,
+			started_at TIMESTAMP(3) NOT NULL,
+			finished_at TIMESTAMP(3) NULL,
+			config JSON NOT NULL,
+			outcome JSON NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS order_status_history (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			order_id VARCHAR(255) NOT NULL,
+			from_status VARCHAR(20) NOT NULL,
+			to_status VARCHAR(20) NOT NULL,
+			reason VARCHAR(255) NOT NULL,
+			changed_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+			KEY idx_order (order_id)
 		)`,
 		`CREATE TABLE IF NOT EXISTS internal_payments (
 			id INT AUTO_INCREMENT PRIMARY KEY,
@@ -66,36 +111,172 @@ func CreateTables() error {
 		`CREATE TABLE IF NOT EXISTS ext_orders (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			order_id VARCHAR(255) NOT NULL,
+			dedupe_order_id VARCHAR(255),
+			client_id VARCHAR(64) NOT NULL,
+			idempotency_key VARCHAR(255),
+			dedupe_idempotency_key VARCHAR(255),
 			destination_phone VARCHAR(20) NOT NULL,
 			amount INT NOT NULL,
+			request_hash CHAR(64) NOT NULL,
 			status VARCHAR(20) NOT NULL,
 			error VARCHAR(255),
-			processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			error_code VARCHAR(50),
+			retryable BOOLEAN NOT NULL DEFAULT FALSE,
+			processed_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+			KEY idx_order (order_id),
+			KEY idx_idempotency_key (client_id, idempotency_key),
+			UNIQUE KEY unique_dedupe_order (dedupe_order_id),
+			UNIQUE KEY unique_dedupe_key (client_id, dedupe_idempotency_key)
 		)`,
 		`CREATE TABLE IF NOT EXISTS fulfillment_attempts (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			order_id VARCHAR(255) NOT NULL,
 			attempt_number INT NOT NULL DEFAULT 1,
 			payload JSON,
+			outcome VARCHAR(20) NULL,
+			error VARCHAR(255) NULL,
 			attempted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`CREATE TABLE IF NOT EXISTS fulfillment_markers (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			order_id VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+			KEY idx_order (order_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS payment_outbox (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			order_id VARCHAR(255) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			dedupe_id VARCHAR(255),
+			payload JSON NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			last_error VARCHAR(255),
+			created_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+			sent_at TIMESTAMP(3) NULL,
+			KEY idx_status (status, id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS inbox (
+			message_id VARCHAR(64) PRIMARY KEY,
+			subject VARCHAR(255) NOT NULL,
+			order_id VARCHAR(255) NOT NULL,
+			deliveries INT NOT NULL DEFAULT 1,
+			processed_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+			last_delivered_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+			completed_at TIMESTAMP(3) NULL,
+			KEY idx_processed_at (processed_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS duplicate_events (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			order_id VARCHAR(255) NOT NULL,
+			message_id VARCHAR(64),
+			layer VARCHAR(20) NOT NULL,
+			detail VARCHAR(255) NOT NULL,
+			detected_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+			KEY idx_detected_at (detected_at)
+		)`,
+		`CREATE TABLE IF NOT EXISTS dead_letters (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			subject VARCHAR(255) NOT NULL,
+			message_id VARCHAR(64) NOT NULL,
+			order_id VARCHAR(255) NOT NULL,
+			payload BLOB NOT NULL,
+			error VARCHAR(1024) NOT NULL,
+			deliveries INT NOT NULL,
+			created_at TIMESTAMP(3) DEFAULT CURRENT_TIMESTAMP(3),
+			redriven_at TIMESTAMP(3) NULL,
+			redrive_count INT NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS fulfillment_claims (
+			order_id VARCHAR(255) PRIMARY KEY,
+			status VARCHAR(20) NOT NULL,
+			owner VARCHAR(255) NOT NULL,
+			lease_expires_at TIMESTAMP(3) NOT NULL,
+			reclaims INT NOT NULL DEFAULT 0,
+			claimed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		)`,
 	}
 
 	for _, query := range queries {
-		if _, err := DB.Exec(query); err != nil {
+		if _, err := db.Exec(query); err != nil {
 			return fmt.Errorf("failed to create table: %w", err)
 		}
 	}
 
-	if _, err := DB.Exec("SET time_zone = '+07:00'"); err != nil {
+	if err := checkColumns(db); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("SET time_zone = '+07:00'"); err != nil {
 		return fmt.Errorf("failed to set timezone: %w", err)
 	}
 
 	return nil
 }
 
+// runHistory is the one table ResetTables keeps, so the outcomes of earlier
+// runs can still be compared after a reset.
+const runHistory = "simulation_runs"
+
+// tableColumns lists the columns every table must have. CREATE TABLE IF NOT
+// EXISTS leaves a table from an older schema as it is, so Migrate refuses to
+// start on one instead of failing on the first query that needs a new column.
+var tableColumns = map[string][]string{
+	"internal_orders":      {"id", "amount", "admin_fee", "type", "operator", "destination_phone", "total", "status", "idempotency_key", "vendor_order_id", "vendor_processed_at", "vendor_error", "retryable", "retry_count", "next_retry_at", "run_id", "created_at"},
+	"order_status_history": {"id", "order_id", "from_status", "to_status", "reason", "changed_at"},
+	"internal_payments":    {"id", "order_id", "paid_amount", "paid_at"},
+	"ext_orders":           {"id", "order_id", "dedupe_order_id", "client_id", "idempotency_key", "dedupe_idempotency_key", "destination_phone", "amount", "request_hash", "status", "error", "error_code", "retryable", "processed_at"},
+	"fulfillment_attempts": {"id", "order_id", "attempt_number", "payload", "outcome", "error", "attempted_at"},
+	"fulfillment_markers":  {"id", "order_id", "created_at"},
+	"payment_outbox":       {"id", "order_id", "subject", "dedupe_id", "payload", "status", "attempts", "last_error", "created_at", "sent_at"},
+	"inbox":                {"message_id", "subject", "order_id", "deliveries", "processed_at", "last_delivered_at", "completed_at"},
+	"duplicate_events":     {"id", "order_id", "message_id", "layer", "detail", "detected_at"},
+	"dead_letters":         {"id", "subject", "message_id", "order_id", "payload", "error", "deliveries", "created_at", "redriven_at", "redrive_count"},
+	"fulfillment_claims":   {"order_id", "status", "owner", "lease_expires_at", "reclaims", "claimed_at", "updated_at"},
+	runHistory:             {"id", "started_at", "finished_at", "config", "outcome"},
+}
+
+func checkColumns(db *sql.DB) error {
+	tables := make([]string, 0, len(tableColumns))
+	for table := range tableColumns {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	query := `SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?`
+	for _, table := range tables {
+		rows, err := db.Query(query, table)
+		if err != nil {
+			return fmt.Errorf("failed to read columns of %s: %w", table, err)
+		}
+		existing := make(map[string]bool)
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to read columns of %s: %w", table, err)
+			}
+			existing[strings.ToLower(column)] = true
+		}
+		rows.Close()
+
+		fix := "run go run ./tooling resetdb"
+		if table == runHistory {
+			fix = "resetdb keeps the run history, so drop the table by hand"
+		}
+		for _, column := range tableColumns[table] {
+			if !existing[column] {
+				return fmt.Errorf("table %s has no column %s, the database was created by an older version: %s", table, column, fix)
+			}
+		}
+	}
+	return nil
+}
+
+// ResetTables drops and recreates every table but runHistory.
 func ResetTables() error {
-	tables := []string{"fulfillment_attempts", "ext_orders", "internal_payments", "internal_orders"}
+	tables := []string{"dead_letters", "duplicate_events", "inbox", "payment_outbox", "fulfillment_claims", "fulfillment_markers", "fulfillment_attempts", "ext_orders", "internal_payments", "order_status_history", "internal_orders"}
 
 	for _, table := range tables {
 		query := fmt.Sprintf("DROP TABLE IF EXISTS %s", table)
@@ -113,3 +294,8 @@ func ResetTables() error {
 	slog.Info("All tables dropped and recreated successfully")
 	return nil
 }
+
+func IsDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
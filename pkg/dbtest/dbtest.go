@@ -0,0 +1,47 @@
+// Package dbtest gives tests the MySQL database configured in the
+// environment. Tests that use it are skipped when DB_NAME is not set.
+package dbtest
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"substack-idempotency/pkg/config"
+	"substack-idempotency/pkg/database"
+)
+
+// Config loads the configuration from the environment, as the services do,
+// and skips the test when no database is configured.
+func Config(t testing.TB) config.Config {
+	t.Helper()
+
+	if os.Getenv("DB_NAME") == "" {
+		t.Skip("DB_NAME is not set, skipping test against MySQL")
+	}
+	cfg, _, err := config.Load("test", nil)
+	if err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+	return cfg
+}
+
+// Open connects to the database and creates the tables. The handle is closed
+// when the test ends.
+func Open(t testing.TB) *sql.DB {
+	t.Helper()
+
+	cfg := Config(t)
+	db, err := database.Open(database.Config(cfg.Database))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	if err := database.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
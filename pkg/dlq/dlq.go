@@ -0,0 +1,88 @@
+package dlq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type Entry struct {
+	ID           int64
+	Subject      string
+	MessageID    string
+	OrderID      string
+	Payload      []byte
+	Error        string
+	Deliveries   int
+	CreatedAt    time.Time
+	RedrivenAt   sql.NullTime
+	RedriveCount int
+}
+
+func Store(ctx context.Context, db *sql.DB, entry Entry) (int64, error) {
+	query := `INSERT INTO dead_letters (subject, message_id, order_id, payload, error, deliveries) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := db.ExecContext(ctx, query, entry.Subject, entry.MessageID, entry.OrderID, entry.Payload, truncate(entry.Error, 1024), entry.Deliveries)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store dead letter: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+func List(ctx context.Context, db *sql.DB, limit int) ([]Entry, error) {
+	query := `SELECT id, subject, message_id, order_id, payload, error, deliveries, created_at, redriven_at, redrive_count
+			  FROM dead_letters
+			  ORDER BY id DESC
+			  LIMIT ?`
+	rows, err := db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		entry, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func Get(ctx context.Context, db *sql.DB, id int64) (Entry, error) {
+	query := `SELECT id, subject, message_id, order_id, payload, error, deliveries, created_at, redriven_at, redrive_count
+			  FROM dead_letters
+			  WHERE id = ?`
+	return scan(db.QueryRowContext(ctx, query, id))
+}
+
+func MarkRedriven(ctx context.Context, db *sql.DB, id int64) error {
+	query := `UPDATE dead_letters SET redriven_at = NOW(3), redrive_count = redrive_count + 1 WHERE id = ?`
+	if _, err := db.ExecContext(ctx, query, id); err != nil {
+		return fmt.Errorf("failed to mark dead letter redriven: %w", err)
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan(row scanner) (Entry, error) {
+	var entry Entry
+	err := row.Scan(&entry.ID, &entry.Subject, &entry.MessageID, &entry.OrderID, &entry.Payload, &entry.Error,
+		&entry.Deliveries, &entry.CreatedAt, &entry.RedrivenAt, &entry.RedriveCount)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to scan dead letter: %w", err)
+	}
+	return entry, nil
+}
+
+func truncate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen]
+}
@@ -0,0 +1,75 @@
+package externalfulfilment
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"substack-idempotency/pkg/models"
+	"substack-idempotency/pkg/utils"
+)
+
+type vendorError struct {
+	Code      string
+	Message   string
+	Retryable bool
+	Rate      int
+}
+
+var errorCatalog = []vendorError{
+	{Code: models.ErrorCodeInvalidNumber, Message: "Destination number is not valid"},
+	{Code: models.ErrorCodeInsufficientBalance, Message: "Vendor deposit balance is insufficient"},
+	{Code: models.ErrorCodeVendorBusy, Message: "Vendor is busy, try again later", Retryable: true},
+	{Code: models.ErrorCodeOperatorDown, Message: "Operator network is down", Retryable: true},
+}
+
+// parseErrorRates reads VENDOR_ERROR_RATES, a comma separated list of
+// CODE=percent pairs, into the catalog. Codes left out never occur.
+func parseErrorRates(value string) ([]vendorError, error) {
+	rates := make(map[string]int)
+	total := 0
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		code, rateStr, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid error rate %q, expected CODE=percent", pair)
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(rateStr))
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid error rate %q, expected a non-negative integer percent", pair)
+		}
+		rates[strings.TrimSpace(code)] = rate
+		total += rate
+	}
+
+	if total > 100 {
+		return nil, fmt.Errorf("error rates add up to %d%%, more than 100%%", total)
+	}
+
+	catalog := make([]vendorError, 0, len(errorCatalog))
+	for _, entry := range errorCatalog {
+		entry.Rate = rates[entry.Code]
+		delete(rates, entry.Code)
+		catalog = append(catalog, entry)
+	}
+	for code := range rates {
+		return nil, fmt.Errorf("unknown error code %q", code)
+	}
+	return catalog, nil
+}
+
+// pickError rolls the dice for one request and returns nil on success.
+func pickError(rng *utils.Rand, catalog []vendorError) *vendorError {
+	chance := rng.Intn(100)
+	for i := range catalog {
+		if chance < catalog[i].Rate {
+			return &catalog[i]
+		}
+		chance -= catalog[i].Rate
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package externalfulfilment
+
+import (
+	"strings"
+	"testing"
+
+	"substack-idempotency/pkg/models"
+	"substack-idempotency/pkg/utils"
+)
+
+func TestParseErrorRates(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]int
+		wantErr string
+	}{
+		{name: "empty", value: "", want: map[string]int{}},
+		{
+			name:  "default",
+			value: "INVALID_NUMBER=3,INSUFFICIENT_BALANCE=2,VENDOR_BUSY=3,OPERATOR_DOWN=2",
+			want: map[string]int{
+				models.ErrorCodeInvalidNumber:       3,
+				models.ErrorCodeInsufficientBalance: 2,
+				models.ErrorCodeVendorBusy:          3,
+				models.ErrorCodeOperatorDown:        2,
+			},
+		},
+		{name: "spaces and blank pairs", value: " VENDOR_BUSY = 40 , ,", want: map[string]int{models.ErrorCodeVendorBusy: 40}},
+		{name: "exactly 100", value: "VENDOR_BUSY=60,OPERATOR_DOWN=40", want: map[string]int{models.ErrorCodeVendorBusy: 60, models.ErrorCodeOperatorDown: 40}},
+		{name: "more than 100", value: "VENDOR_BUSY=60,OPERATOR_DOWN=41", wantErr: "more than 100%"},
+		{name: "unknown code", value: "VENDOR_ON_FIRE=1", wantErr: "unknown error code"},
+		{name: "missing rate", value: "VENDOR_BUSY", wantErr: "expected CODE=percent"},
+		{name: "negative rate", value: "VENDOR_BUSY=-1", wantErr: "non-negative integer"},
+		{name: "fractional rate", value: "VENDOR_BUSY=1.5", wantErr: "non-negative integer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			catalog, err := parseErrorRates(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseErrorRates(%q) error = %v, want it to mention %q", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseErrorRates(%q) = %v", tt.value, err)
+			}
+
+			if len(catalog) != len(errorCatalog) {
+				t.Fatalf("catalog has %d codes, want %d", len(catalog), len(errorCatalog))
+			}
+			for _, entry := range catalog {
+				if entry.Rate != tt.want[entry.Code] {
+					t.Errorf("%s rate = %d, want %d", entry.Code, entry.Rate, tt.want[entry.Code])
+				}
+			}
+		})
+	}
+}
+
+func TestPickError(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "no errors", value: "", want: ""},
+		{name: "always busy", value: "VENDOR_BUSY=100", want: models.ErrorCodeVendorBusy},
+		{name: "always operator down", value: "INVALID_NUMBER=0,OPERATOR_DOWN=100", want: models.ErrorCodeOperatorDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			catalog, err := parseErrorRates(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rng := utils.NewRand(1)
+			for i := 0; i < 100; i++ {
+				got := ""
+				if vendorErr := pickError(rng, catalog); vendorErr != nil {
+					got = vendorErr.Code
+				}
+				if got != tt.want {
+					t.Fatalf("pickError() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+package externalfulfilment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/config"
+	"substack-idempotency/pkg/database"
+	"substack-idempotency/pkg/faults"
+	"substack-idempotency/pkg/httpserver"
+	"substack-idempotency/pkg/idempotency"
+	"substack-idempotency/pkg/models"
+	"substack-idempotency/pkg/utils"
+)
+
+type Server struct {
+	cfg      config.Config
+	settings *admin.Settings[Settings]
+	db       *sql.DB
+	listener net.Listener
+}
+
+// NewServer validates the error rates, connects to the database, creates the
+// tables and binds cfg.Vendor.Addr. Run releases the handles on exit.
+func NewServer(cfg config.Config) (*Server, error) {
+	s := &Server{cfg: cfg}
+	var err error
+	s.settings, err = s.newSettings()
+	if err != nil {
+		return nil, fmt.Errorf("invalid vendor settings: %w", err)
+	}
+
+	s.db, err = database.Open(database.Config(cfg.Database))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.Migrate(s.db); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	s.listener, err = net.Listen("tcp", cfg.Vendor.Addr)
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", cfg.Vendor.Addr, err)
+	}
+	return s, nil
+}
+
+// Close releases the handles NewServer opened. Run calls it on exit.
+func (s *Server) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.db.Close()
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/process-order", s.processOrder)
+	mux.HandleFunc("GET /orders/{orderID}", s.getOrder)
+	mux.HandleFunc("/health", healthCheck)
+	admin.Register(mux, s.cfg.Admin.Token, s.settings)
+
+	slog.Info("External Order Fulfillment Service starting on " + s.listener.Addr().String())
+	return httpserver.Serve(ctx, s.listener, mux)
+}
+
+func (s *Server) processOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.ExternalFulfillmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request", "error", err)
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var idempotencyKey string
+	if value := r.Header.Get(idempotency.HeaderKey); value != "" {
+		key, err := idempotency.ParseKey(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		idempotencyKey = key
+	}
+
+	requestHash, err := requestFingerprint(req)
+	if err != nil {
+		slog.Error("Failed to fingerprint request", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	clientID := r.Header.Get(idempotency.HeaderClientID)
+	if clientID == "" {
+		clientID = idempotency.AnonymousClient
+	}
+
+	correlationID := req.CorrelationID
+	if correlationID == "" {
+		correlationID = utils.GenerateCorrelationID()
+		slog.Info("Generated new correlation ID for request", "correlation_id", correlationID, "order_id", req.OrderID)
+	} else {
+		slog.Info("Using correlation ID from request", "correlation_id", correlationID, "order_id", req.OrderID)
+	}
+
+	logPrefix := "[" + correlationID + "] "
+	settings := s.settings.Load()
+
+	slog.Info(logPrefix+"Processing external fulfillment request", "order_id", req.OrderID, "amount", req.Amount, "client_id", clientID, "idempotency_key", idempotencyKey, "external_idempotency_check", settings.IdempotencyCheck)
+
+	if settings.IdempotencyCheck {
+		existingOrder, err := s.findExistingOrder(clientID, idempotencyKey, req.OrderID)
+		if err == nil {
+			s.respondExisting(w, logPrefix, existingOrder, req, idempotencyKey, requestHash)
+			return
+		}
+		if err != sql.ErrNoRows {
+			slog.Error(logPrefix+"Failed to look up existing order", "error", err)
+		}
+	} else {
+		slog.Warn(logPrefix + "External idempotency check is disabled, processing all requests")
+	}
+
+	// With the check on, dedupe_order_id and dedupe_idempotency_key carry the
+	// unique constraints that keep ext_orders at one row per order and one row
+	// per client and key. They stay NULL when the check is off so duplicate
+	// rows can still be recorded.
+	dedupeOrderID := sql.NullString{String: req.OrderID, Valid: settings.IdempotencyCheck}
+	dedupeKey := sql.NullString{String: idempotencyKey, Valid: settings.IdempotencyCheck && idempotencyKey != ""}
+
+	query := `INSERT INTO ext_orders (order_id, dedupe_order_id, client_id, idempotency_key, dedupe_idempotency_key, destination_phone, amount, request_hash, status, error, processed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := s.db.Exec(query, req.OrderID, dedupeOrderID, clientID, sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}, dedupeKey,
+		req.DestinationPhone, req.Amount, requestHash, "processing", "", time.Now())
+	if err != nil {
+		if database.IsDuplicateKey(err) {
+			existingOrder, err := s.findConflictingOrder(clientID, idempotencyKey, req.OrderID)
+			if err == nil {
+				s.respondExisting(w, logPrefix, existingOrder, req, idempotencyKey, requestHash)
+				return
+			}
+		}
+		slog.Error(logPrefix+"Failed to insert order", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+
+	s.settleOrder(w, logPrefix, models.ExtOrder{
+		ID:               int(id),
+		OrderID:          req.OrderID,
+		ClientID:         clientID,
+		IdempotencyKey:   idempotencyKey,
+		DestinationPhone: req.DestinationPhone,
+		Amount:           req.Amount,
+		RequestHash:      requestHash,
+	})
+}
+
+// settleOrder decides the outcome of a row that is in processing, stores it,
+// and writes the response.
+func (s *Server) settleOrder(w http.ResponseWriter, logPrefix string, order models.ExtOrder) {
+	settings := s.settings.Load()
+
+	if err := settings.faults.Hit(faults.VendorAfterInsert, settings.rand); err != nil {
+		slog.Error(logPrefix+"Failed to settle order", "order_id", order.OrderID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	order.Status = "success"
+	order.Error = ""
+	order.ErrorCode = ""
+	order.Retryable = false
+	if vendorErr := pickError(settings.rand, settings.errorRates); vendorErr != nil {
+		order.Status = "error"
+		order.Error = vendorErr.Message
+		order.ErrorCode = vendorErr.Code
+		order.Retryable = vendorErr.Retryable
+		slog.Info(logPrefix+"Vendor error generated", "order_id", order.OrderID, "error_code", vendorErr.Code, "retryable", vendorErr.Retryable)
+	}
+
+	order.ProcessedAt = time.Now()
+
+	slog.Info(logPrefix+"Storing order in database", "order_id", order.OrderID, "processed_at", order.ProcessedAt.Format("2006-01-02 15:04:05 -0700"), "timezone", order.ProcessedAt.Location().String())
+
+	query := `UPDATE ext_orders SET status = ?, error = ?, error_code = ?, retryable = ?, processed_at = ? WHERE id = ?`
+	errorCode := sql.NullString{String: order.ErrorCode, Valid: order.ErrorCode != ""}
+	if _, err := s.db.Exec(query, order.Status, order.Error, errorCode, order.Retryable, order.ProcessedAt, order.ID); err != nil {
+		slog.Error(logPrefix+"Failed to update order", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info(logPrefix+"External fulfillment processed", "order_id", order.OrderID, "status", order.Status, "external_idempotency_check", settings.IdempotencyCheck)
+
+	if err := settings.faults.Hit(faults.VendorBeforeResponse, settings.rand); err != nil {
+		slog.Error(logPrefix+"Failed to respond", "order_id", order.OrderID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeOrderResponse(w, order, false)
+}
+
+// getOrder lets a client find out what happened to an order whose
+// /process-order response it never received.
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := r.PathValue("orderID")
+
+	order, err := s.findExistingOrder("", "", orderID)
+	if err == nil && order.Status == "processing" && time.Since(order.ProcessedAt) >= s.settings.Load().processingLease() {
+		slog.Info("Status inquiry for an order whose processing lease ran out", "order_id", orderID)
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		slog.Info("Status inquiry for unknown order", "order_id", orderID)
+		writeProblem(w, models.ProblemDetails{
+			Type:    "/errors/order-not-found",
+			Title:   "No order with this order-id has been received",
+			Status:  http.StatusNotFound,
+			OrderID: orderID,
+		})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to look up order", "order_id", orderID, "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Status inquiry", "order_id", orderID, "status", order.Status)
+	writeOrderResponse(w, order, false)
+}
+
+func (s *Server) respondExisting(w http.ResponseWriter, logPrefix string, existingOrder models.ExtOrder, req models.ExternalFulfillmentRequest, idempotencyKey string, requestHash string) {
+	if existingOrder.RequestHash != requestHash {
+		slog.Warn(logPrefix+"External idempotency: Key reused with a different payload", "order_id", req.OrderID, "idempotency_key", idempotencyKey, "existing_order_id", existingOrder.OrderID)
+		writeProblem(w, models.ProblemDetails{
+			Type:           "/errors/idempotency-key-mismatch",
+			Title:          "Idempotency key reused with a different request",
+			Status:         http.StatusUnprocessableEntity,
+			Detail:         "The request body does not match the request originally sent with this key",
+			OrderID:        req.OrderID,
+			IdempotencyKey: idempotencyKey,
+		})
+		return
+	}
+
+	if existingOrder.Status == "processing" {
+		reattempt, err := s.takeOverProcessing(existingOrder.ID)
+		if err != nil {
+			slog.Error(logPrefix+"Failed to take over processing order", "error", err)
+		}
+		if reattempt {
+			slog.Info(logPrefix+"External idempotency: Re-attempting order whose processing lease ran out", "order_id", req.OrderID, "idempotency_key", idempotencyKey)
+			s.settleOrder(w, logPrefix, existingOrder)
+			return
+		}
+
+		slog.Info(logPrefix+"External idempotency: Original request still in flight", "order_id", req.OrderID, "idempotency_key", idempotencyKey)
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, models.ProblemDetails{
+			Type:           "/errors/idempotency-key-in-flight",
+			Title:          "A request with this idempotency key is still being processed",
+			Status:         http.StatusConflict,
+			OrderID:        req.OrderID,
+			IdempotencyKey: idempotencyKey,
+		})
+		return
+	}
+
+	if existingOrder.Status == "error" && existingOrder.Retryable {
+		reattempt, err := s.reopenRetryable(existingOrder.ID)
+		if err != nil {
+			slog.Error(logPrefix+"Failed to reopen retryable order", "error", err)
+		}
+		if reattempt {
+			slog.Info(logPrefix+"External idempotency: Re-attempting order after retryable error", "order_id", req.OrderID, "idempotency_key", idempotencyKey, "error_code", existingOrder.ErrorCode)
+			s.settleOrder(w, logPrefix, existingOrder)
+			return
+		}
+	}
+
+	slog.Info(logPrefix+"External idempotency: Duplicate request detected, returning existing result", "order_id", req.OrderID, "idempotency_key", idempotencyKey, "existing_status", existingOrder.Status)
+	writeOrderResponse(w, existingOrder, true)
+}
+
+// reopenRetryable puts a row that ended in a retryable error back into
+// processing so the same row is attempted again. Until the replay window has
+// passed, duplicates keep getting the stored error instead.
+func (s *Server) reopenRetryable(id int) (bool, error) {
+	query := `UPDATE ext_orders SET status = 'processing', processed_at = NOW(3)
+			  WHERE id = ? AND status = 'error' AND retryable AND processed_at <= NOW(3) - INTERVAL ? MICROSECOND`
+	return s.reopen(query, id, s.settings.Load().retryableReplay())
+}
+
+// takeOverProcessing renews the lease on a row left in processing by a
+// request that died before settling it, so this request attempts it again.
+// A row whose lease has not run out yet still belongs to its request.
+func (s *Server) takeOverProcessing(id int) (bool, error) {
+	query := `UPDATE ext_orders SET processed_at = NOW(3)
+			  WHERE id = ? AND status = 'processing' AND processed_at <= NOW(3) - INTERVAL ? MICROSECOND`
+	return s.reopen(query, id, s.settings.Load().processingLease())
+}
+
+func (s *Server) reopen(query string, id int, after time.Duration) (bool, error) {
+	result, err := s.db.Exec(query, id, after.Microseconds())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// findConflictingOrder finds the row an INSERT collided with. A concurrent
+// request may have taken the client's key or the order-id, so the key is
+// looked up first and the order-id after it.
+func (s *Server) findConflictingOrder(clientID string, idempotencyKey string, orderID string) (models.ExtOrder, error) {
+	if idempotencyKey != "" {
+		order, err := s.findExistingOrder(clientID, idempotencyKey, orderID)
+		if err != sql.ErrNoRows {
+			return order, err
+		}
+	}
+	return s.findExistingOrder(clientID, "", orderID)
+}
+
+// findExistingOrder looks a request up by its Idempotency-Key when the client
+// sent one, scoped to that client, and falls back to the order-id otherwise.
+func (s *Server) findExistingOrder(clientID string, idempotencyKey string, orderID string) (models.ExtOrder, error) {
+	query := `SELECT id, order_id, client_id, COALESCE(idempotency_key, ''), destination_phone, amount, request_hash, status, error, COALESCE(error_code, ''), retryable, processed_at
+			  FROM ext_orders WHERE order_id = ? ORDER BY id ASC LIMIT 1`
+	args := []interface{}{orderID}
+	if idempotencyKey != "" {
+		query = `SELECT id, order_id, client_id, COALESCE(idempotency_key, ''), destination_phone, amount, request_hash, status, error, COALESCE(error_code, ''), retryable, processed_at
+				 FROM ext_orders WHERE client_id = ? AND idempotency_key = ? ORDER BY id ASC LIMIT 1`
+		args = []interface{}{clientID, idempotencyKey}
+	}
+
+	var order models.ExtOrder
+	err := s.db.QueryRow(query, args...).Scan(
+		&order.ID,
+		&order.OrderID,
+		&order.ClientID,
+		&order.IdempotencyKey,
+		&order.DestinationPhone,
+		&order.Amount,
+		&order.RequestHash,
+		&order.Status,
+		&order.Error,
+		&order.ErrorCode,
+		&order.Retryable,
+		&order.ProcessedAt,
+	)
+	return order, err
+}
+
+// requestFingerprint hashes the fields that define the order. The
+// correlation-id changes on every attempt, so it is left out.
+func requestFingerprint(req models.ExternalFulfillmentRequest) (string, error) {
+	req.CorrelationID = ""
+	return idempotency.Fingerprint(req)
+}
+
+func writeProblem(w http.ResponseWriter, problem models.ProblemDetails) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func writeOrderResponse(w http.ResponseWriter, order models.ExtOrder, replayed bool) {
+	var responseData interface{}
+	if order.Status == "success" {
+		responseData = models.SuccessData{
+			OrderID:       order.OrderID,
+			VendorOrderID: order.ID,
+			ProcessedAt:   order.ProcessedAt.Format(models.VendorTimeLayout),
+		}
+	}
+
+	response := models.ExternalFulfillmentResponse{
+		Status:    order.Status,
+		Error:     order.Error,
+		ErrorCode: order.ErrorCode,
+		Retryable: order.Retryable,
+		Data:      responseData,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if replayed {
+		w.Header().Set(idempotency.HeaderReplayed, "true")
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,63 @@
+package externalfulfilment
+
+import (
+	"fmt"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/faults"
+	"substack-idempotency/pkg/utils"
+)
+
+// Settings are the parts of the configuration that can be changed at runtime
+// through /admin/config.
+type Settings struct {
+	IdempotencyCheck  bool   `json:"idempotency_check"`
+	ErrorRates        string `json:"error_rates"`
+	RetryableReplayMs int    `json:"retryable_replay_ms"`
+	ProcessingLeaseMs int    `json:"processing_lease_ms"`
+	Faults            string `json:"faults"`
+	Seed              int64  `json:"seed"`
+
+	errorRates []vendorError
+	faults     faults.Set
+	rand       *utils.Rand
+}
+
+func (s Settings) retryableReplay() time.Duration {
+	return time.Duration(s.RetryableReplayMs) * time.Millisecond
+}
+
+func (s Settings) processingLease() time.Duration {
+	return time.Duration(s.ProcessingLeaseMs) * time.Millisecond
+}
+
+func (s *Server) newSettings() (*admin.Settings[Settings], error) {
+	initial := Settings{
+		IdempotencyCheck:  s.cfg.Vendor.IdempotencyCheck,
+		ErrorRates:        s.cfg.Vendor.ErrorRates,
+		RetryableReplayMs: int(s.cfg.Vendor.RetryableReplay.Milliseconds()),
+		ProcessingLeaseMs: int(s.cfg.Vendor.ProcessingLease.Milliseconds()),
+		Faults:            s.cfg.Vendor.Faults,
+		Seed:              s.cfg.Random.Seed,
+	}
+	return admin.NewSettings("external-order-fulfilment", initial, prepareSettings)
+}
+
+func prepareSettings(settings *Settings) error {
+	if settings.ProcessingLeaseMs <= 0 {
+		return fmt.Errorf("processing_lease_ms must be positive")
+	}
+	errorRates, err := parseErrorRates(settings.ErrorRates)
+	if err != nil {
+		return err
+	}
+	armed, err := faults.Parse(settings.Faults, faults.VendorPoints)
+	if err != nil {
+		return err
+	}
+	settings.errorRates = errorRates
+	settings.faults = armed
+	settings.rand = utils.NewRand(settings.Seed)
+	return nil
+}
@@ -0,0 +1,164 @@
+package faults
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"substack-idempotency/pkg/utils"
+)
+
+// Point names a place in the flow where a fault can be injected. Each one
+// sits between two steps whose order matters for idempotency.
+type Point string
+
+const (
+	// OrderAfterClaim fires once the idempotency strategy granted the order,
+	// before fulfilment is dispatched and the inbox entry is completed.
+	OrderAfterClaim Point = "order.after-claim"
+	// OrderAfterVendorSuccess fires once the vendor answered, before the
+	// result is stored and the order status updated.
+	OrderAfterVendorSuccess Point = "order.after-vendor-success"
+	// OrderBeforeAck fires after dispatch started, before the inbox entry is
+	// completed and the message acked.
+	OrderBeforeAck Point = "order.before-ack"
+
+	// PaymentBeforeCommit fires after the payment and its outbox rows are
+	// written, before the transaction commits.
+	PaymentBeforeCommit Point = "payment.before-commit"
+	// PaymentAfterCommit fires after the payment is stored, before the client
+	// gets its response.
+	PaymentAfterCommit Point = "payment.after-commit"
+	// PaymentAfterPublish fires after the relay published an outbox row,
+	// before the row is marked sent.
+	PaymentAfterPublish Point = "payment.after-publish"
+
+	// VendorAfterInsert fires after the vendor stored the order as
+	// processing, before it is settled.
+	VendorAfterInsert Point = "vendor.after-insert"
+	// VendorBeforeResponse fires after the vendor settled the order, before
+	// the response is written.
+	VendorBeforeResponse Point = "vendor.before-response"
+)
+
+var (
+	OrderPoints   = []Point{OrderAfterClaim, OrderAfterVendorSuccess, OrderBeforeAck}
+	PaymentPoints = []Point{PaymentBeforeCommit, PaymentAfterCommit, PaymentAfterPublish}
+	VendorPoints  = []Point{VendorAfterInsert, VendorBeforeResponse}
+)
+
+type Action string
+
+const (
+	ActionPanic   Action = "panic"
+	ActionExit    Action = "exit"
+	ActionError   Action = "error"
+	ActionLatency Action = "latency"
+)
+
+// ExitCode is the status the process exits with on an exit fault.
+const ExitCode = 3
+
+var ErrInjected = errors.New("injected fault")
+
+type Fault struct {
+	Point   Point
+	Action  Action
+	Delay   time.Duration
+	Percent int
+}
+
+// Set is the faults armed in one service, at most one per point.
+type Set map[Point]Fault
+
+// Parse reads a comma separated list of point=action[:delay][@percent]
+// entries, e.g. "order.after-claim=exit,order.after-vendor-success=latency:2s@50".
+// Only the given points are accepted. Without @percent a fault fires every
+// time its point is reached.
+func Parse(spec string, points []Point) (Set, error) {
+	set := make(Set)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		point, rest, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q, expected point=action", entry)
+		}
+		fault := Fault{Point: Point(strings.TrimSpace(point)), Percent: 100}
+		if !slices.Contains(points, fault.Point) {
+			return nil, fmt.Errorf("unknown fault point %q, expected one of %s", point, joinPoints(points))
+		}
+		if _, exists := set[fault.Point]; exists {
+			return nil, fmt.Errorf("fault point %q is armed twice", point)
+		}
+
+		if action, percent, ok := strings.Cut(rest, "@"); ok {
+			n, err := strconv.Atoi(percent)
+			if err != nil || n < 0 || n > 100 {
+				return nil, fmt.Errorf("invalid fault %q, percent must be 0 to 100", entry)
+			}
+			fault.Percent = n
+			rest = action
+		}
+
+		action, delay, hasDelay := strings.Cut(rest, ":")
+		fault.Action = Action(action)
+		switch fault.Action {
+		case ActionPanic, ActionExit, ActionError:
+			if hasDelay {
+				return nil, fmt.Errorf("invalid fault %q, only latency takes a delay", entry)
+			}
+		case ActionLatency:
+			d, err := time.ParseDuration(delay)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid fault %q, latency needs a positive delay such as latency:500ms", entry)
+			}
+			fault.Delay = d
+		default:
+			return nil, fmt.Errorf("invalid fault %q, action must be panic, exit, error or latency", entry)
+		}
+
+		set[fault.Point] = fault
+	}
+	return set, nil
+}
+
+// Hit runs the fault armed at point, if any. Latency sleeps and returns nil;
+// error returns ErrInjected for the caller to handle like any other failure
+// at that step; panic and exit do what they say. Whether a fault under 100
+// percent fires is drawn from r.
+func (s Set) Hit(point Point, r *utils.Rand) error {
+	fault, ok := s[point]
+	if !ok || r.Intn(100) >= fault.Percent {
+		return nil
+	}
+
+	slog.Warn("Injecting fault", "point", point, "action", fault.Action, "delay", fault.Delay)
+	switch fault.Action {
+	case ActionLatency:
+		time.Sleep(fault.Delay)
+	case ActionError:
+		return fmt.Errorf("%w at %s", ErrInjected, point)
+	case ActionPanic:
+		panic(fmt.Sprintf("injected fault at %s", point))
+	case ActionExit:
+		os.Exit(ExitCode)
+	}
+	return nil
+}
+
+func joinPoints(points []Point) string {
+	names := make([]string, len(points))
+	for i, p := range points {
+		names[i] = string(p)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,105 @@
+package faults
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"substack-idempotency/pkg/utils"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    Set
+		wantErr string
+	}{
+		{name: "empty", spec: "", want: Set{}},
+		{name: "blank entries", spec: " , ,", want: Set{}},
+		{
+			name: "error",
+			spec: "order.after-claim=error",
+			want: Set{OrderAfterClaim: {Point: OrderAfterClaim, Action: ActionError, Percent: 100}},
+		},
+		{
+			name: "latency with percent",
+			spec: "order.after-vendor-success=latency:2s@50",
+			want: Set{OrderAfterVendorSuccess: {Point: OrderAfterVendorSuccess, Action: ActionLatency, Delay: 2 * time.Second, Percent: 50}},
+		},
+		{
+			name: "several points",
+			spec: " order.after-claim=exit , order.before-ack=panic@0 ",
+			want: Set{
+				OrderAfterClaim: {Point: OrderAfterClaim, Action: ActionExit, Percent: 100},
+				OrderBeforeAck:  {Point: OrderBeforeAck, Action: ActionPanic, Percent: 0},
+			},
+		},
+		{name: "missing action", spec: "order.after-claim", wantErr: "expected point=action"},
+		{name: "point of another service", spec: "vendor.after-insert=error", wantErr: "unknown fault point"},
+		{name: "point armed twice", spec: "order.after-claim=error,order.after-claim=exit", wantErr: "armed twice"},
+		{name: "unknown action", spec: "order.after-claim=crash", wantErr: "action must be"},
+		{name: "delay on error", spec: "order.after-claim=error:1s", wantErr: "only latency takes a delay"},
+		{name: "latency without delay", spec: "order.after-claim=latency", wantErr: "positive delay"},
+		{name: "zero latency", spec: "order.after-claim=latency:0s", wantErr: "positive delay"},
+		{name: "percent above 100", spec: "order.after-claim=error@101", wantErr: "percent must be 0 to 100"},
+		{name: "negative percent", spec: "order.after-claim=error@-1", wantErr: "percent must be 0 to 100"},
+		{name: "percent not a number", spec: "order.after-claim=error@half", wantErr: "percent must be 0 to 100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.spec, OrderPoints)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse(%q) error = %v, want it to mention %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q) = %v", tt.spec, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHit(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		wantErr   bool
+		wantSleep time.Duration
+	}{
+		{name: "unarmed", spec: ""},
+		{name: "other point", spec: "order.before-ack=error"},
+		{name: "error", spec: "order.after-claim=error", wantErr: true},
+		{name: "error at 0 percent", spec: "order.after-claim=error@0"},
+		{name: "latency", spec: "order.after-claim=latency:20ms", wantSleep: 20 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := Parse(tt.spec, OrderPoints)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+			err = set.Hit(OrderAfterClaim, utils.NewRand(1))
+			if tt.wantErr != errors.Is(err, ErrInjected) {
+				t.Errorf("Hit() = %v, want injected error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Hit() = %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantSleep {
+				t.Errorf("Hit() returned after %v, want at least %v", elapsed, tt.wantSleep)
+			}
+		})
+	}
+}
@@ -23,17 +23,45 @@ func NewClient(timeout time.Duration) *Client {
 }
 
 func (c *Client) PostJSON(ctx context.Context, url string, payload interface{}) (*http.Response, error) {
+	return c.PostJSONWithHeaders(ctx, url, payload, nil)
+}
+
+func (c *Client) PostJSONWithHeaders(ctx context.Context, url string, payload interface{}, headers map[string]string) (*http.Response, error) {
+	return c.sendJSON(ctx, "POST", url, payload, headers)
+}
+
+func (c *Client) PatchJSONWithHeaders(ctx context.Context, url string, payload interface{}, headers map[string]string) (*http.Response, error) {
+	return c.sendJSON(ctx, "PATCH", url, payload, headers)
+}
+
+func (c *Client) sendJSON(ctx context.Context, method string, url string, payload interface{}, headers map[string]string) (*http.Response, error) {
 	reqBody, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	return c.httpClient.Do(req)
+}
+
+func (c *Client) GetWithHeaders(ctx context.Context, url string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
 
 	return c.httpClient.Do(req)
 }
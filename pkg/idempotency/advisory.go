@@ -0,0 +1,66 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// advisoryLock uses MySQL GET_LOCK. The lock belongs to the session, so the
+// check and the release must run on the same pooled connection.
+type advisoryLock struct {
+	db             *sql.DB
+	timeoutSeconds int
+}
+
+func (s *advisoryLock) Name() string {
+	return AdvisoryLock
+}
+
+func (s *advisoryLock) Acquire(ctx context.Context, orderID string) (bool, error) {
+	return s.withLock(ctx, orderID, func(conn *sql.Conn) (bool, error) {
+		count, err := countMarkers(ctx, conn, orderID)
+		if err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return false, nil
+		}
+
+		if err := recordMarker(ctx, conn, orderID); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Reclaim only reads the order's status. The lock would be released before
+// the vendor call, so a retry that races another dispatch is stopped by the
+// paid to fulfilment compare-and-set instead.
+func (s *advisoryLock) Reclaim(ctx context.Context, orderID string) (bool, error) {
+	return awaitingDispatch(ctx, s.db, `SELECT status FROM internal_orders WHERE id = ?`, orderID)
+}
+
+func (s *advisoryLock) withLock(ctx context.Context, orderID string, fn func(conn *sql.Conn) (bool, error)) (bool, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	lockName := "fulfillment:" + orderID
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, s.timeoutSeconds).Scan(&locked); err != nil {
+		return false, fmt.Errorf("failed to get advisory lock: %w", err)
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return false, fmt.Errorf("timed out waiting for advisory lock %s", lockName)
+	}
+	defer func() {
+		var released sql.NullInt64
+		conn.QueryRowContext(context.Background(), "SELECT RELEASE_LOCK(?)", lockName).Scan(&released)
+	}()
+
+	return fn(conn)
+}
@@ -0,0 +1,124 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"substack-idempotency/pkg/database"
+)
+
+const (
+	ClaimClaimed    = "claimed"
+	ClaimDispatched = "dispatched"
+	ClaimDone       = "done"
+	ClaimFailed     = "failed"
+)
+
+var ErrClaimLost = errors.New("fulfillment claim is owned by another worker")
+
+// Tracker is implemented by strategies that follow a claim through dispatch.
+// Release fails whatever claim is still held on the order, by any owner, once
+// the vendor is known to have no record of it.
+type Tracker interface {
+	Mark(ctx context.Context, orderID string, status string) error
+	Release(ctx context.Context, orderID string) error
+}
+
+// uniqueClaim lets the primary key on fulfillment_claims pick the winner. A
+// claim that is still claimed or dispatched when its lease runs out belongs to
+// a worker that died, so the next delivery may take it over. A failed claim is
+// only taken over by a fulfilment retry, through Reclaim.
+type uniqueClaim struct {
+	db    *sql.DB
+	owner string
+	lease time.Duration
+}
+
+func newUniqueClaim(db *sql.DB, lease time.Duration) *uniqueClaim {
+	hostname, _ := os.Hostname()
+	return &uniqueClaim{
+		db:    db,
+		owner: fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		lease: lease,
+	}
+}
+
+func (s *uniqueClaim) Name() string {
+	return UniqueClaim
+}
+
+func (s *uniqueClaim) Acquire(ctx context.Context, orderID string) (bool, error) {
+	leaseMicros := s.lease.Microseconds()
+
+	query := `INSERT INTO fulfillment_claims (order_id, status, owner, lease_expires_at)
+			  VALUES (?, ?, ?, NOW(3) + INTERVAL ? MICROSECOND)`
+	_, err := s.db.ExecContext(ctx, query, orderID, ClaimClaimed, s.owner, leaseMicros)
+	if err == nil {
+		return true, nil
+	}
+	if !database.IsDuplicateKey(err) {
+		return false, fmt.Errorf("failed to insert fulfillment claim: %w", err)
+	}
+
+	query = `UPDATE fulfillment_claims
+			 SET status = ?, owner = ?, lease_expires_at = NOW(3) + INTERVAL ? MICROSECOND, reclaims = reclaims + 1
+			 WHERE order_id = ? AND status IN (?, ?) AND lease_expires_at < NOW(3)`
+	result, err := s.db.ExecContext(ctx, query, ClaimClaimed, s.owner, leaseMicros, orderID, ClaimClaimed, ClaimDispatched)
+	if err != nil {
+		return false, fmt.Errorf("failed to reclaim expired fulfillment claim: %w", err)
+	}
+	return takenOver(result)
+}
+
+// Reclaim takes over a claim for a fulfilment retry: one that failed, or one
+// whose lease ran out. A claim that is still held, or done, is left alone.
+func (s *uniqueClaim) Reclaim(ctx context.Context, orderID string) (bool, error) {
+	query := `UPDATE fulfillment_claims
+			  SET status = ?, owner = ?, lease_expires_at = NOW(3) + INTERVAL ? MICROSECOND, reclaims = reclaims + 1
+			  WHERE order_id = ? AND (status = ? OR (status IN (?, ?) AND lease_expires_at < NOW(3)))`
+	result, err := s.db.ExecContext(ctx, query, ClaimClaimed, s.owner, s.lease.Microseconds(), orderID, ClaimFailed, ClaimClaimed, ClaimDispatched)
+	if err != nil {
+		return false, fmt.Errorf("failed to reclaim fulfillment claim for retry: %w", err)
+	}
+	return takenOver(result)
+}
+
+func takenOver(result sql.Result) (bool, error) {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to read reclaim result: %w", err)
+	}
+	return affected == 1, nil
+}
+
+func (s *uniqueClaim) Release(ctx context.Context, orderID string) error {
+	query := `UPDATE fulfillment_claims SET status = ?, lease_expires_at = NOW(3)
+			  WHERE order_id = ? AND status IN (?, ?)`
+	if _, err := s.db.ExecContext(ctx, query, ClaimFailed, orderID, ClaimClaimed, ClaimDispatched); err != nil {
+		return fmt.Errorf("failed to release fulfillment claim: %w", err)
+	}
+	return nil
+}
+
+func (s *uniqueClaim) Mark(ctx context.Context, orderID string, status string) error {
+	query := `UPDATE fulfillment_claims
+			  SET status = ?, lease_expires_at = NOW(3) + INTERVAL ? MICROSECOND
+			  WHERE order_id = ? AND owner = ? AND status IN (?, ?)`
+	result, err := s.db.ExecContext(ctx, query, status, s.lease.Microseconds(), orderID, s.owner, ClaimClaimed, ClaimDispatched)
+	if err != nil {
+		return fmt.Errorf("failed to mark fulfillment claim %s: %w", status, err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read claim update result: %w", err)
+	}
+	if affected == 0 {
+		return ErrClaimLost
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+)
+
+// countAfterInsert is the original check. Two concurrent deliveries can both
+// insert before either counts, so both see 2 and neither dispatches, or both
+// count before the other inserts and both dispatch.
+type countAfterInsert struct {
+	db *sql.DB
+}
+
+func (s *countAfterInsert) Name() string {
+	return CountAfterInsert
+}
+
+func (s *countAfterInsert) Acquire(ctx context.Context, orderID string) (bool, error) {
+	if err := recordMarker(ctx, s.db, orderID); err != nil {
+		return false, err
+	}
+
+	count, err := countMarkers(ctx, s.db, orderID)
+	if err != nil {
+		return false, err
+	}
+	return count <= 1, nil
+}
+
+// Reclaim only reads the order's status. A retry that races another dispatch
+// is stopped by the paid to fulfilment compare-and-set before the vendor call.
+func (s *countAfterInsert) Reclaim(ctx context.Context, orderID string) (bool, error) {
+	return awaitingDispatch(ctx, s.db, `SELECT status FROM internal_orders WHERE id = ?`, orderID)
+}
@@ -0,0 +1,55 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// selectForUpdate serialises deliveries on the order row lock, so the
+// count-then-insert runs as one critical section across instances.
+type selectForUpdate struct {
+	db *sql.DB
+}
+
+func (s *selectForUpdate) Name() string {
+	return SelectForUpdate
+}
+
+func (s *selectForUpdate) Acquire(ctx context.Context, orderID string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id string
+	query := `SELECT id FROM internal_orders WHERE id = ? FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, orderID).Scan(&id); err != nil {
+		return false, fmt.Errorf("failed to lock order: %w", err)
+	}
+
+	count, err := countMarkers(ctx, tx, orderID)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	if err := recordMarker(ctx, tx, orderID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+// Reclaim only reads the order's status. No lock would outlive the check, so
+// a retry that races another dispatch is stopped by the paid to fulfilment
+// compare-and-set before the vendor call.
+func (s *selectForUpdate) Reclaim(ctx context.Context, orderID string) (bool, error) {
+	return awaitingDispatch(ctx, s.db, `SELECT status FROM internal_orders WHERE id = ?`, orderID)
+}
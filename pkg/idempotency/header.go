@@ -0,0 +1,55 @@
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	HeaderKey      = "Idempotency-Key"
+	HeaderReplayed = "Idempotent-Replayed"
+	HeaderClientID = "X-Client-Id"
+
+	AnonymousClient = "anonymous"
+)
+
+var ErrInvalidKey = errors.New("invalid Idempotency-Key header")
+
+// FormatKey encodes a key as the structured-field string the IETF draft
+// specifies, e.g. "0190a1b2-...".
+func FormatKey(key string) string {
+	return strconv.Quote(key)
+}
+
+// ParseKey accepts the quoted form from the draft as well as a bare token,
+// since most clients in the wild send the key unquoted.
+func ParseKey(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", ErrInvalidKey
+		}
+		value = unquoted
+	}
+
+	if value == "" || len(value) > 255 {
+		return "", ErrInvalidKey
+	}
+	return value, nil
+}
+
+// Fingerprint is the hex SHA-256 of v's JSON encoding. Struct fields encode
+// in declaration order, so equal values always hash the same.
+func Fingerprint(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,50 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// singleflightStrategy collapses concurrent deliveries inside one process
+// only. A second service instance still races the count-then-insert.
+type singleflightStrategy struct {
+	db    *sql.DB
+	group singleflight.Group
+}
+
+func (s *singleflightStrategy) Name() string {
+	return Singleflight
+}
+
+func (s *singleflightStrategy) Acquire(ctx context.Context, orderID string) (bool, error) {
+	acquired := false
+	_, err, _ := s.group.Do(orderID, func() (interface{}, error) {
+		count, err := countMarkers(ctx, s.db, orderID)
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, nil
+		}
+		if err := recordMarker(ctx, s.db, orderID); err != nil {
+			return nil, err
+		}
+		acquired = true
+		return nil, nil
+	})
+	return acquired, err
+}
+
+// Reclaim shares the delivery's flight, so a retry that overlaps a delivery
+// in this process gets nothing.
+func (s *singleflightStrategy) Reclaim(ctx context.Context, orderID string) (bool, error) {
+	paid := false
+	_, err, shared := s.group.Do(orderID, func() (interface{}, error) {
+		var err error
+		paid, err = awaitingDispatch(ctx, s.db, `SELECT status FROM internal_orders WHERE id = ?`, orderID)
+		return nil, err
+	})
+	return paid && !shared, err
+}
@@ -0,0 +1,85 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"substack-idempotency/pkg/orderstate"
+)
+
+const (
+	CountAfterInsert = "count-after-insert"
+	UniqueClaim      = "unique-claim"
+	SelectForUpdate  = "select-for-update"
+	AdvisoryLock     = "advisory-lock"
+	Singleflight     = "singleflight"
+)
+
+// Strategy decides whether a payment.paid delivery may dispatch fulfilment
+// for an order. Acquire returns false when another delivery already won.
+// Reclaim is for the fulfilment retry worker only: it may hand over an order
+// an earlier dispatch already acquired, which a redelivery must never get.
+type Strategy interface {
+	Name() string
+	Acquire(ctx context.Context, orderID string) (bool, error)
+	Reclaim(ctx context.Context, orderID string) (bool, error)
+}
+
+func Names() []string {
+	return []string{CountAfterInsert, UniqueClaim, SelectForUpdate, AdvisoryLock, Singleflight}
+}
+
+func New(name string, db *sql.DB, claimLease time.Duration) (Strategy, error) {
+	switch name {
+	case CountAfterInsert:
+		return &countAfterInsert{db: db}, nil
+	case "", UniqueClaim:
+		return newUniqueClaim(db, claimLease), nil
+	case SelectForUpdate:
+		return &selectForUpdate{db: db}, nil
+	case AdvisoryLock:
+		return &advisoryLock{db: db, timeoutSeconds: 5}, nil
+	case Singleflight:
+		return &singleflightStrategy{db: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown idempotency strategy: %s", name)
+	}
+}
+
+type execQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// recordMarker notes that a delivery went through the check. The markers are
+// kept apart from fulfillment_attempts, which only holds real dispatches.
+func recordMarker(ctx context.Context, db execQuerier, orderID string) error {
+	query := `INSERT INTO fulfillment_markers (order_id) VALUES (?)`
+	if _, err := db.ExecContext(ctx, query, orderID); err != nil {
+		return fmt.Errorf("failed to insert fulfillment marker: %w", err)
+	}
+	return nil
+}
+
+// awaitingDispatch reports whether the order is paid, or failed and due for
+// another try, rather than held by a dispatch. The strategies that count
+// markers keep no claim a retry could take over, so they guard a retry on the
+// order itself.
+func awaitingDispatch(ctx context.Context, db execQuerier, query string, orderID string) (bool, error) {
+	var status string
+	if err := db.QueryRowContext(ctx, query, orderID).Scan(&status); err != nil {
+		return false, fmt.Errorf("failed to read order status: %w", err)
+	}
+	return status == orderstate.Paid || status == orderstate.Failed, nil
+}
+
+func countMarkers(ctx context.Context, db execQuerier, orderID string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM fulfillment_markers WHERE order_id = ?`
+	if err := db.QueryRowContext(ctx, query, orderID).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count fulfillment markers: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,80 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Record marks messageID as received inside tx and reports whether this is
+// its first delivery, and whether an earlier delivery already completed.
+// Redeliveries bump the deliveries counter instead, and block on the row lock
+// until the first delivery's transaction finishes.
+func Record(ctx context.Context, tx *sql.Tx, messageID string, subject string, orderID string) (first bool, completed bool, err error) {
+	query := `INSERT INTO inbox (message_id, subject, order_id) VALUES (?, ?, ?)
+			  ON DUPLICATE KEY UPDATE deliveries = deliveries + 1, last_delivered_at = NOW(3)`
+	result, err := tx.ExecContext(ctx, query, messageID, subject, orderID)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to record inbox message: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, false, fmt.Errorf("failed to read inbox result: %w", err)
+	}
+	if affected == 1 {
+		return true, false, nil
+	}
+
+	query = `SELECT completed_at IS NOT NULL FROM inbox WHERE message_id = ?`
+	if err := tx.QueryRowContext(ctx, query, messageID).Scan(&completed); err != nil {
+		return false, false, fmt.Errorf("failed to read inbox message: %w", err)
+	}
+	return false, completed, nil
+}
+
+// Complete marks a message as fully handled, so later redeliveries can be
+// skipped outright rather than resumed.
+func Complete(ctx context.Context, db *sql.DB, messageID string) error {
+	query := `UPDATE inbox SET completed_at = NOW(3) WHERE message_id = ? AND completed_at IS NULL`
+	if _, err := db.ExecContext(ctx, query, messageID); err != nil {
+		return fmt.Errorf("failed to complete inbox message: %w", err)
+	}
+	return nil
+}
+
+func Cleanup(ctx context.Context, db *sql.DB, retention time.Duration) (int64, error) {
+	query := `DELETE FROM inbox WHERE processed_at < NOW(3) - INTERVAL ? SECOND`
+	result, err := db.ExecContext(ctx, query, int64(retention.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to clean up inbox: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// RunCleanup deletes inbox rows older than retention every interval. A
+// redelivery that arrives after its row is gone is treated as new, so the
+// retention must outlive the broker's redelivery window.
+func RunCleanup(ctx context.Context, db *sql.DB, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleted, err := Cleanup(ctx, db, retention)
+		if err != nil {
+			slog.Error("Failed to clean up inbox", "error", err)
+			continue
+		}
+		if deleted > 0 {
+			slog.Info("Inbox cleanup completed", "deleted", deleted, "retention", retention.String())
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package inbox
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"substack-idempotency/pkg/dbtest"
+	"substack-idempotency/pkg/utils"
+)
+
+func record(t *testing.T, db *sql.DB, messageID string, commit bool) (bool, bool) {
+	t.Helper()
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	first, completed, err := Record(ctx, tx, messageID, "payment.paid", "order-"+messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit {
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return first, completed
+}
+
+func deliveries(t *testing.T, db *sql.DB, messageID string) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT deliveries FROM inbox WHERE message_id = ?`, messageID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRecordDedupesDeliveries(t *testing.T) {
+	db := dbtest.Open(t)
+	messageID := utils.GenerateUUID7()
+
+	steps := []struct {
+		name           string
+		rollback       bool
+		complete       bool
+		wantFirst      bool
+		wantCompleted  bool
+		wantDeliveries int
+	}{
+		// A delivery whose transaction rolls back leaves no trace, so the
+		// redelivery is handled as the first one.
+		{name: "rolled back delivery", rollback: true, wantFirst: true},
+		{name: "first delivery", wantFirst: true, wantDeliveries: 1},
+		{name: "redelivery before completion", wantFirst: false, wantCompleted: false, wantDeliveries: 2},
+		{name: "redelivery after completion", complete: true, wantFirst: false, wantCompleted: true, wantDeliveries: 3},
+		{name: "second redelivery after completion", wantFirst: false, wantCompleted: true, wantDeliveries: 4},
+	}
+
+	for _, step := range steps {
+		if step.complete {
+			if err := Complete(context.Background(), db, messageID); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		first, completed := record(t, db, messageID, !step.rollback)
+		if first != step.wantFirst || completed != step.wantCompleted {
+			t.Errorf("%s: Record() = (first %v, completed %v), want (%v, %v)", step.name, first, completed, step.wantFirst, step.wantCompleted)
+		}
+		if step.rollback {
+			continue
+		}
+		if got := deliveries(t, db, messageID); got != step.wantDeliveries {
+			t.Errorf("%s: deliveries = %d, want %d", step.name, got, step.wantDeliveries)
+		}
+	}
+}
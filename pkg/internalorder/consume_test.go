@@ -0,0 +1,201 @@
+package internalorder
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"substack-idempotency/pkg/dbtest"
+	"substack-idempotency/pkg/dlq"
+	"substack-idempotency/pkg/idempotency"
+	"substack-idempotency/pkg/models"
+	"substack-idempotency/pkg/nats"
+	"substack-idempotency/pkg/natstest"
+	"substack-idempotency/pkg/utils"
+
+	natspkg "github.com/nats-io/nats.go"
+)
+
+// newTestServer runs internal-order against the MySQL database from the
+// environment and an embedded NATS server. The vendor answers every dispatch
+// with a retryable 503, so a dispatch settles without leaving the test.
+func newTestServer(t *testing.T, idempotencyCheck bool, orderFaults string) *Server {
+	t.Helper()
+
+	vendor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(vendor.Close)
+
+	cfg := dbtest.Config(t)
+	cfg.NATS.URL = natstest.Start(t)
+	cfg.NATS.AckWait = 2 * time.Second
+	cfg.NATS.MaxDeliver = 3
+	cfg.NATS.NakBackoff = 10 * time.Millisecond
+	cfg.Order.Addr = "127.0.0.1:0"
+	cfg.Order.IdempotencyCheck = idempotencyCheck
+	cfg.Order.IdempotencyStrategy = idempotency.UniqueClaim
+	cfg.Order.Faults = orderFaults
+	cfg.Vendor.URL = vendor.URL
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.nats.Consume(ctx, s.paymentPaidConsumer(), s.consumePaymentPaid); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func insertOrder(t *testing.T, s *Server) models.Order {
+	t.Helper()
+
+	order := utils.GenerateRandomOrder(utils.NewRand(0))
+	query := `INSERT INTO internal_orders (id, amount, admin_fee, type, operator, destination_phone, total, status, idempotency_key, created_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := s.db.Exec(query, order.ID, order.Amount, order.AdminFee, order.Type, order.Operator,
+		order.DestinationPhone, order.Total, order.Status, order.IdempotencyKey, order.CreatedAt); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func publishPaid(t *testing.T, s *Server, order models.Order) models.PaymentPaidMessage {
+	t.Helper()
+
+	message := models.PaymentPaidMessage{
+		MessageID:     utils.GenerateUUID7(),
+		OrderID:       order.ID,
+		PaidAmount:    order.Total,
+		PaidAt:        time.Now(),
+		CorrelationID: utils.GenerateCorrelationID(),
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.nats.PublishJS(nats.SubjectPaymentPaid, message.MessageID, data); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(15 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func count(t *testing.T, s *Server, query string, args ...interface{}) int {
+	t.Helper()
+
+	var n int
+	if err := s.db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// consumerSettled reports whether every message the consumer was given has
+// been acked or terminated.
+func consumerSettled(t *testing.T, s *Server) bool {
+	t.Helper()
+
+	info, err := s.nats.JS.ConsumerInfo(s.cfg.NATS.Stream, s.cfg.NATS.Durable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.NumPending == 0 && info.NumAckPending == 0
+}
+
+// A delivery that commits the paid status and dispatches, then dies before
+// it acks, is redelivered. The redelivery resumes at the fulfilment decision,
+// finds the claim taken, and acks without a second dispatch.
+func TestConsumeAcksAfterCommit(t *testing.T) {
+	s := newTestServer(t, true, "order.before-ack=error")
+	order := insertOrder(t, s)
+	message := publishPaid(t, s, order)
+
+	eventually(t, "the redelivery to complete the inbox entry", func() bool {
+		return count(t, s, `SELECT COUNT(*) FROM inbox WHERE message_id = ? AND deliveries = 2 AND completed_at IS NOT NULL`, message.MessageID) == 1
+	})
+	eventually(t, "the message to be acked", func() bool {
+		return consumerSettled(t, s)
+	})
+	eventually(t, "the dispatch to settle", func() bool {
+		return count(t, s, `SELECT COUNT(*) FROM fulfillment_attempts WHERE order_id = ? AND outcome IS NOT NULL`, order.ID) == 1
+	})
+
+	if n := count(t, s, `SELECT COUNT(*) FROM fulfillment_attempts WHERE order_id = ?`, order.ID); n != 1 {
+		t.Errorf("order was dispatched %d times, want 1", n)
+	}
+	if n := count(t, s, `SELECT COUNT(*) FROM duplicate_events WHERE order_id = ? AND message_id = ?`, order.ID, message.MessageID); n != 1 {
+		t.Errorf("recorded %d duplicates for the redelivery, want 1", n)
+	}
+}
+
+func TestConsumeDeadLetters(t *testing.T) {
+	tests := []struct {
+		name           string
+		faults         string
+		poison         bool
+		wantDeliveries int
+	}{
+		{name: "max deliver", faults: "order.after-claim=error", wantDeliveries: 3},
+		{name: "poison message", poison: true, wantDeliveries: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, false, tt.faults)
+			if tt.poison {
+				if _, err := s.nats.PublishJS(nats.SubjectPaymentPaid, utils.GenerateUUID7(), []byte("not json")); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				publishPaid(t, s, insertOrder(t, s))
+			}
+
+			var dlqMsg *natspkg.RawStreamMsg
+			eventually(t, "the dead letter", func() bool {
+				msg, err := s.nats.JS.GetLastMsg(s.cfg.NATS.Stream, nats.SubjectPaymentPaidDLQ)
+				dlqMsg = msg
+				return err == nil
+			})
+			eventually(t, "the message to be terminated", func() bool {
+				return consumerSettled(t, s)
+			})
+
+			if got := dlqMsg.Header.Get("Dlq-Deliveries"); got != strconv.Itoa(tt.wantDeliveries) {
+				t.Errorf("Dlq-Deliveries = %q, want %d", got, tt.wantDeliveries)
+			}
+
+			id, err := strconv.ParseInt(dlqMsg.Header.Get("Dlq-Id"), 10, 64)
+			if err != nil {
+				t.Fatalf("invalid Dlq-Id: %v", err)
+			}
+			entry, err := dlq.Get(context.Background(), s.db, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Deliveries != tt.wantDeliveries {
+				t.Errorf("dead_letters.deliveries = %d, want %d", entry.Deliveries, tt.wantDeliveries)
+			}
+		})
+	}
+}
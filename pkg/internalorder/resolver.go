@@ -0,0 +1,103 @@
+package internalorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"substack-idempotency/pkg/httpclient"
+	"substack-idempotency/pkg/idempotency"
+	"substack-idempotency/pkg/orderstate"
+)
+
+// resolveOrder settles an order whose vendor call ended without a response.
+// It asks the vendor what happened instead of submitting the order again, and
+// only schedules another dispatch when the vendor has no record of it.
+func (s *Server) resolveOrder(ctx context.Context, orderID string, correlationID string) {
+	logPrefix := "[" + correlationID + "] "
+
+	settings := s.settings.Load()
+	timeout := settings.vendorTimeout()
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	headers := map[string]string{
+		idempotency.HeaderClientID: "internal-order",
+	}
+
+	client := httpclient.NewClient(timeout)
+	resp, err := client.GetWithHeaders(reqCtx, s.vendorURL(settings)+"/orders/"+url.PathEscape(orderID), headers)
+	if err != nil {
+		slog.Error(logPrefix+"Failed to query vendor order status", "order_id", orderID, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		slog.Info(logPrefix+"Vendor has no record of the order, scheduling another dispatch", "order_id", orderID)
+		requeued, err := s.requeueUnknown(ctx, orderID)
+		if err != nil {
+			slog.Error(logPrefix+"Failed to move unknown order back to paid", "order_id", orderID, "error", err)
+			return
+		}
+		if requeued {
+			s.releaseClaim(orderID, logPrefix)
+		}
+		return
+	default:
+		slog.Error(logPrefix+"Vendor order status inquiry failed", "order_id", orderID, "status", resp.StatusCode)
+		return
+	}
+
+	status, result, err := decodeVendorResponse(resp.Body)
+	if err != nil {
+		slog.Error(logPrefix+"Failed to decode vendor order status", "order_id", orderID, "error", err)
+		return
+	}
+
+	slog.Info(logPrefix+"Resolved unknown order with the vendor", "order_id", orderID, "vendor_status", status)
+	s.settleVendorResult(orderID, orderstate.Unknown, status, result, logPrefix)
+}
+
+// releaseClaim fails the claim the lost dispatch still holds, so the retry
+// worker can reclaim it for the next dispatch instead of waiting out its lease.
+func (s *Server) releaseClaim(orderID string, logPrefix string) {
+	tracker, ok := s.settings.Load().strategy.(idempotency.Tracker)
+	if !ok {
+		return
+	}
+	if err := tracker.Release(context.Background(), orderID); err != nil {
+		slog.Error(logPrefix+"Failed to release fulfillment claim", "order_id", orderID, "error", err)
+	}
+}
+
+// requeueUnknown moves the order back to paid for another dispatch, and
+// reports false when another worker already moved it out of unknown.
+func (s *Server) requeueUnknown(ctx context.Context, orderID string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = orderstate.Transition(ctx, tx, orderID, orderstate.Unknown, orderstate.Paid, "vendor has no record of order")
+	if errors.Is(err, orderstate.ErrStaleStatus) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := scheduleRetry(ctx, tx, orderID, 0); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit requeue: %w", err)
+	}
+	return true, nil
+}
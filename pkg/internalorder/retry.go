@@ -0,0 +1,231 @@
+package internalorder
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"substack-idempotency/pkg/idempotency"
+	"substack-idempotency/pkg/orderstate"
+	"substack-idempotency/pkg/utils"
+)
+
+const (
+	attemptInFlight = "in_flight"
+	attemptUnknown  = "unknown"
+	attemptAborted  = "aborted"
+)
+
+type retryPolicy struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// delay doubles Base for every retry already made, caps it at Max, and picks
+// a random point in the upper half so retries of many orders spread out.
+func (p retryPolicy) delay(retries int) time.Duration {
+	d := p.Max
+	if retries < 30 {
+		d = min(p.Base<<retries, p.Max)
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func scheduleRetry(ctx context.Context, tx *sql.Tx, orderID string, delay time.Duration) error {
+	query := `UPDATE internal_orders SET next_retry_at = NOW(3) + INTERVAL ? MICROSECOND WHERE id = ?`
+	if _, err := tx.ExecContext(ctx, query, delay.Microseconds(), orderID); err != nil {
+		return fmt.Errorf("failed to schedule retry: %w", err)
+	}
+	return nil
+}
+
+// scheduleBackoff schedules the next retry from the order's retry count, or
+// leaves the order where it is once the retries are used up.
+func (s *Server) scheduleBackoff(ctx context.Context, tx *sql.Tx, orderID string, logPrefix string) error {
+	var retryCount int
+	query := `SELECT retry_count FROM internal_orders WHERE id = ?`
+	if err := tx.QueryRowContext(ctx, query, orderID).Scan(&retryCount); err != nil {
+		return fmt.Errorf("failed to read retry count: %w", err)
+	}
+
+	if retryCount >= s.settings.Load().MaxRetries {
+		slog.Warn(logPrefix+"Fulfilment retries exhausted", "order_id", orderID, "retry_count", retryCount)
+		return nil
+	}
+	return scheduleRetry(ctx, tx, orderID, s.retry.delay(retryCount))
+}
+
+func (s *Server) recordAttemptOutcome(attemptID int64, outcome string, errMsg string, logPrefix string) {
+	if attemptID == 0 {
+		return
+	}
+
+	query := `UPDATE fulfillment_attempts SET outcome = ?, error = ? WHERE id = ?`
+	if _, err := s.db.Exec(query, outcome, sql.NullString{String: errMsg, Valid: errMsg != ""}, attemptID); err != nil {
+		slog.Error(logPrefix+"Failed to record fulfillment attempt outcome", "attempt_id", attemptID, "error", err)
+	}
+}
+
+// runRetryWorker picks up orders whose next_retry_at has passed: paid orders
+// that were never dispatched, failed orders with a retryable error, unknown
+// orders that still need a status inquiry, and orders stuck in fulfilment
+// because their dispatch died before the vendor answered. Every dispatch
+// reuses the order's Idempotency-Key.
+func (s *Server) runRetryWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.retryDueOrders(ctx)
+		}
+	}
+}
+
+type dueOrder struct {
+	ID         string
+	Status     string
+	RetryCount int
+}
+
+func (s *Server) retryDueOrders(ctx context.Context) {
+	query := `SELECT id, status, retry_count FROM internal_orders
+			  WHERE next_retry_at <= NOW(3) AND retry_count < ?
+			    AND (status IN (?, ?, ?) OR (status = ? AND retryable))
+			  ORDER BY next_retry_at ASC
+			  LIMIT 20`
+	rows, err := s.db.QueryContext(ctx, query, s.settings.Load().MaxRetries, orderstate.Paid, orderstate.Unknown, orderstate.Fulfilment, orderstate.Failed)
+	if err != nil {
+		slog.Error("Failed to query orders due for retry", "error", err)
+		return
+	}
+
+	var orders []dueOrder
+	for rows.Next() {
+		var order dueOrder
+		if err := rows.Scan(&order.ID, &order.Status, &order.RetryCount); err != nil {
+			slog.Error("Failed to scan order due for retry", "error", err)
+			continue
+		}
+		orders = append(orders, order)
+	}
+	rows.Close()
+
+	for _, order := range orders {
+		s.retryOrder(ctx, order, utils.GenerateCorrelationID())
+	}
+}
+
+// retryOrder asks the strategy for the order before the retry is counted, so
+// a retry that is only postponed does not use up one of max_retries.
+func (s *Server) retryOrder(ctx context.Context, order dueOrder, correlationID string) {
+	logPrefix := "[" + correlationID + "] "
+	settings := s.settings.Load()
+
+	dispatch := order.Status == orderstate.Paid || order.Status == orderstate.Failed
+	if dispatch && settings.IdempotencyCheck {
+		acquired, err := settings.strategy.Reclaim(ctx, order.ID)
+		if err != nil {
+			slog.Error(logPrefix+"Idempotency check failed for retry", "order_id", order.ID, "strategy", settings.strategy.Name(), "error", err)
+			return
+		}
+		if !acquired {
+			slog.Info(logPrefix+"Order is held by another dispatch, retry postponed", "order_id", order.ID, "strategy", settings.strategy.Name())
+			if err := s.postponeRetry(ctx, order); err != nil {
+				slog.Error(logPrefix+"Failed to postpone fulfilment retry", "order_id", order.ID, "error", err)
+			}
+			return
+		}
+	}
+
+	taken, err := s.takeRetry(ctx, order)
+	if err != nil {
+		slog.Error(logPrefix+"Failed to take fulfilment retry", "order_id", order.ID, "error", err)
+	}
+	if !taken {
+		if dispatch {
+			s.markClaim(order.ID, idempotency.ClaimFailed, logPrefix)
+		}
+		return
+	}
+
+	slog.Info(logPrefix+"Retrying order no. "+strconv.Itoa(order.RetryCount+1), "order_id", order.ID, "status", order.Status)
+
+	if !dispatch {
+		s.resolveOrder(ctx, order.ID, correlationID)
+		return
+	}
+	s.processFulfillment(order.ID, correlationID)
+}
+
+// postponeRetry moves next_retry_at out by a claim lease without counting a
+// retry, so the order is looked at again once the other dispatch is done.
+func (s *Server) postponeRetry(ctx context.Context, order dueOrder) error {
+	query := `UPDATE internal_orders SET next_retry_at = NOW(3) + INTERVAL ? MICROSECOND
+			  WHERE id = ? AND status = ? AND retry_count = ?`
+	if _, err := s.db.ExecContext(ctx, query, s.cfg.Order.ClaimLease.Microseconds(), order.ID, order.Status, order.RetryCount); err != nil {
+		return fmt.Errorf("failed to postpone retry: %w", err)
+	}
+	return nil
+}
+
+// takeRetry counts the retry with a compare-and-set on retry_count, so only
+// one worker retries a given order at a time. next_retry_at is pushed out so
+// the order comes back if this retry dies before it settles. An order stuck in
+// fulfilment is moved to unknown, so it is settled by a status inquiry rather
+// than dispatched again.
+func (s *Server) takeRetry(ctx context.Context, order dueOrder) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	lease := s.cfg.Order.ClaimLease
+	if order.Status == orderstate.Unknown || order.Status == orderstate.Fulfilment {
+		lease = s.retry.delay(order.RetryCount + 1)
+	}
+
+	query := `UPDATE internal_orders
+			  SET retry_count = retry_count + 1, retryable = FALSE, next_retry_at = NOW(3) + INTERVAL ? MICROSECOND
+			  WHERE id = ? AND status = ? AND retry_count = ?`
+	result, err := tx.ExecContext(ctx, query, lease.Microseconds(), order.ID, order.Status, order.RetryCount)
+	if err != nil {
+		return false, fmt.Errorf("failed to count retry: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to read retry update result: %w", err)
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	switch order.Status {
+	case orderstate.Failed:
+		reason := "fulfilment retry " + strconv.Itoa(order.RetryCount+1)
+		if err := orderstate.Transition(ctx, tx, order.ID, orderstate.Failed, orderstate.Paid, reason); err != nil {
+			return false, err
+		}
+	case orderstate.Fulfilment:
+		if err := orderstate.Transition(ctx, tx, order.ID, orderstate.Fulfilment, orderstate.Unknown, "fulfilment stalled"); err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit retry: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,52 @@
+package internalorder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{Base: time.Second, Max: time.Minute}
+
+	tests := []struct {
+		retries int
+		ceiling time.Duration
+	}{
+		{retries: 0, ceiling: time.Second},
+		{retries: 1, ceiling: 2 * time.Second},
+		{retries: 3, ceiling: 8 * time.Second},
+		{retries: 5, ceiling: 32 * time.Second},
+		{retries: 6, ceiling: time.Minute},
+		{retries: 29, ceiling: time.Minute},
+		{retries: 30, ceiling: time.Minute},
+		{retries: 100, ceiling: time.Minute},
+	}
+
+	for _, tt := range tests {
+		// The jitter picks a point in the upper half of the backoff, so
+		// every delay falls in [ceiling/2, ceiling).
+		floor := tt.ceiling / 2
+		for i := 0; i < 1000; i++ {
+			d := policy.delay(tt.retries)
+			if d < floor || d >= tt.ceiling {
+				t.Fatalf("delay(%d) = %v, want it in [%v, %v)", tt.retries, d, floor, tt.ceiling)
+			}
+		}
+	}
+}
+
+func TestRetryPolicyDelayWithoutRoomForJitter(t *testing.T) {
+	tests := []struct {
+		policy retryPolicy
+		want   time.Duration
+	}{
+		{policy: retryPolicy{Base: 1, Max: 1}, want: 1},
+		{policy: retryPolicy{Base: 0, Max: time.Second}, want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.delay(0); got != tt.want {
+			t.Errorf("%+v.delay(0) = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
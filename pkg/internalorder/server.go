@@ -0,0 +1,637 @@
+package internalorder
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/audit"
+	"substack-idempotency/pkg/config"
+	"substack-idempotency/pkg/database"
+	"substack-idempotency/pkg/dlq"
+	"substack-idempotency/pkg/faults"
+	"substack-idempotency/pkg/httpclient"
+	"substack-idempotency/pkg/httpserver"
+	"substack-idempotency/pkg/idempotency"
+	"substack-idempotency/pkg/inbox"
+	"substack-idempotency/pkg/models"
+	"substack-idempotency/pkg/nats"
+	"substack-idempotency/pkg/orderstate"
+	"substack-idempotency/pkg/utils"
+
+	natspkg "github.com/nats-io/nats.go"
+)
+
+var errPoisonMessage = errors.New("poison message")
+
+type Server struct {
+	cfg          config.Config
+	db           *sql.DB
+	nats         *nats.Client
+	settings     *admin.Settings[Settings]
+	strategies   map[string]idempotency.Strategy
+	strategiesMu sync.Mutex
+	retry        retryPolicy
+	listener     net.Listener
+}
+
+// NewServer connects to the database and NATS, creates the tables and the
+// payment stream, and binds cfg.Order.Addr, so the service accepts requests as soon
+// as it returns. Run starts the workers and releases everything on exit.
+func NewServer(cfg config.Config) (*Server, error) {
+	db, err := database.Open(database.Config(cfg.Database))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		cfg:        cfg,
+		db:         db,
+		strategies: make(map[string]idempotency.Strategy),
+		retry: retryPolicy{
+			Base: cfg.Order.RetryBase,
+			Max:  cfg.Order.RetryMax,
+		},
+	}
+	if err := s.init(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) init() error {
+	if err := database.Migrate(s.db); err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	var err error
+	s.settings, err = s.newSettings()
+	if err != nil {
+		return fmt.Errorf("invalid order settings: %w", err)
+	}
+
+	s.nats, err = nats.Connect(s.cfg.NATS.URL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	s.nats.Faults = s.natsFaults
+
+	streamCfg := nats.StreamConfig{
+		Name:       s.cfg.NATS.Stream,
+		Subjects:   nats.PaymentSubjects,
+		Duplicates: s.cfg.NATS.DuplicateWindow,
+	}
+	if err := s.nats.EnsureStream(streamCfg); err != nil {
+		return fmt.Errorf("failed to ensure NATS stream: %w", err)
+	}
+
+	s.listener, err = net.Listen("tcp", s.cfg.Order.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.Order.Addr, err)
+	}
+	return nil
+}
+
+// Close releases the handles NewServer opened. Run calls it on exit.
+func (s *Server) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.nats != nil {
+		s.nats.Close()
+	}
+	s.db.Close()
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go inbox.RunCleanup(ctx, s.db, s.cfg.Order.InboxRetention, time.Hour)
+	go s.runRetryWorker(ctx, s.cfg.Order.RetryPoll)
+
+	if err := s.nats.Consume(ctx, s.paymentPaidConsumer(), s.consumePaymentPaid); err != nil {
+		return fmt.Errorf("failed to consume payment.paid: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/create-order", s.createOrder)
+	mux.HandleFunc("/health", healthCheck)
+	admin.Register(mux, s.cfg.Admin.Token, s.settings)
+
+	slog.Info("Internal Order Service starting on " + s.listener.Addr().String())
+	return httpserver.Serve(ctx, s.listener, mux)
+}
+
+func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	correlationID := utils.GenerateCorrelationID()
+	logPrefix := "[" + correlationID + "] "
+	order := utils.GenerateRandomOrder(s.settings.Load().rand)
+	order.RunID = r.Header.Get(models.HeaderRunID)
+
+	slog.Info(logPrefix+"Creating order", "order", order)
+
+	query := `INSERT INTO internal_orders (id, amount, admin_fee, type, operator, destination_phone, total, status, idempotency_key, run_id, created_at) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	if _, err := s.db.Exec(query, order.ID, order.Amount, order.AdminFee, order.Type,
+		order.Operator, order.DestinationPhone, order.Total, order.Status, order.IdempotencyKey,
+		sql.NullString{String: order.RunID, Valid: order.RunID != ""}, order.CreatedAt); err != nil {
+		slog.Error(logPrefix+"Failed to insert order", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info(logPrefix+"Order created successfully", "order_id", order.ID)
+
+	response := models.CreateOrderResponse{
+		ID:               order.ID,
+		Status:           order.Status,
+		Amount:           order.Amount,
+		AdminFee:         order.AdminFee,
+		Total:            order.Total,
+		Operator:         order.Operator,
+		DestinationPhone: order.DestinationPhone,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) paymentPaidConsumer() nats.ConsumerConfig {
+	return nats.ConsumerConfig{
+		Stream:     s.cfg.NATS.Stream,
+		Durable:    s.cfg.NATS.Durable,
+		Subject:    nats.SubjectPaymentPaid,
+		AckWait:    s.cfg.NATS.AckWait,
+		MaxDeliver: s.cfg.NATS.MaxDeliver,
+		BatchSize:  s.cfg.NATS.FetchBatch,
+	}
+}
+
+// consumePaymentPaid acks a message once it is handled. Failures are
+// redelivered with exponential backoff; a poison message, or one that has
+// used up NATS_MAX_DELIVER deliveries, is dead-lettered and terminated.
+func (s *Server) consumePaymentPaid(msg *natspkg.Msg) {
+	err := s.handlePaymentPaid(msg)
+	if err == nil {
+		if err := msg.Ack(); err != nil {
+			slog.Error("Failed to ack payment.paid message", "error", err)
+		}
+		return
+	}
+
+	deliveries := 1
+	if meta, metaErr := msg.Metadata(); metaErr == nil {
+		deliveries = int(meta.NumDelivered)
+	}
+
+	if !errors.Is(err, errPoisonMessage) && (s.cfg.NATS.MaxDeliver <= 0 || deliveries < s.cfg.NATS.MaxDeliver) {
+		delay := s.backoff(deliveries)
+		slog.Warn("Failed to handle payment.paid message, retrying", "error", err, "deliveries", deliveries, "retry_in", delay.String())
+		msg.NakWithDelay(delay)
+		return
+	}
+
+	if dlqErr := s.deadLetter(msg, err, deliveries); dlqErr != nil {
+		slog.Error("Failed to dead-letter payment.paid message", "error", dlqErr, "cause", err)
+		msg.Nak()
+		return
+	}
+	msg.Term()
+}
+
+func (s *Server) backoff(deliveries int) time.Duration {
+	delay := s.cfg.NATS.NakBackoff << (deliveries - 1)
+	if delay <= 0 || delay > time.Minute {
+		return time.Minute
+	}
+	return delay
+}
+
+func (s *Server) deadLetter(msg *natspkg.Msg, cause error, deliveries int) error {
+	var paymentMsg models.PaymentPaidMessage
+	json.Unmarshal(msg.Data, &paymentMsg)
+
+	id, err := dlq.Store(context.Background(), s.db, dlq.Entry{
+		Subject:    msg.Subject,
+		MessageID:  paymentMsg.MessageID,
+		OrderID:    paymentMsg.OrderID,
+		Payload:    msg.Data,
+		Error:      cause.Error(),
+		Deliveries: deliveries,
+	})
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{
+		"Dlq-Id":               strconv.FormatInt(id, 10),
+		"Dlq-Original-Subject": msg.Subject,
+		"Dlq-Error":            cause.Error(),
+		"Dlq-Deliveries":       strconv.Itoa(deliveries),
+	}
+	if err := s.nats.PublishJSWithHeaders(nats.SubjectPaymentPaidDLQ, headers, msg.Data); err != nil {
+		slog.Error("Failed to publish dead letter", "dlq_id", id, "error", err)
+	}
+
+	slog.Error("Dead-lettered payment.paid message", "dlq_id", id, "order_id", paymentMsg.OrderID, "message_id", paymentMsg.MessageID, "deliveries", deliveries, "error", cause)
+	return nil
+}
+
+func (s *Server) handlePaymentPaid(msg *natspkg.Msg) error {
+	var paymentMsg models.PaymentPaidMessage
+	if err := json.Unmarshal(msg.Data, &paymentMsg); err != nil {
+		return fmt.Errorf("%w: %v", errPoisonMessage, err)
+	}
+
+	correlationID := paymentMsg.CorrelationID
+	if correlationID == "" {
+		correlationID = utils.GenerateCorrelationID()
+	}
+
+	logPrefix := "[" + correlationID + "] "
+
+	slog.Info(logPrefix+"Received payment.paid message", "order_id", paymentMsg.OrderID, "message_id", paymentMsg.MessageID)
+
+	ctx := context.Background()
+	settings := s.settings.Load()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	firstDelivery, completed := true, false
+	if paymentMsg.MessageID != "" {
+		firstDelivery, completed, err = inbox.Record(ctx, tx, paymentMsg.MessageID, msg.Subject, paymentMsg.OrderID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !firstDelivery && settings.IdempotencyCheck && completed {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit inbox redelivery: %w", err)
+		}
+		slog.Info(logPrefix+"Skipping redelivered message", "order_id", paymentMsg.OrderID, "message_id", paymentMsg.MessageID)
+		s.recordDuplicate(ctx, logPrefix, paymentMsg.OrderID, paymentMsg.MessageID, audit.LayerInbox, "message already completed")
+		return nil
+	}
+
+	statusUpdated := false
+	if firstDelivery || !settings.IdempotencyCheck {
+		err := orderstate.Transition(ctx, tx, paymentMsg.OrderID, orderstate.Pending, orderstate.Paid, "payment.paid "+paymentMsg.MessageID)
+		switch {
+		case err == nil:
+			statusUpdated = true
+			if err := scheduleRetry(ctx, tx, paymentMsg.OrderID, s.cfg.Order.ClaimLease); err != nil {
+				return err
+			}
+		case errors.Is(err, orderstate.ErrStaleStatus):
+			slog.Info(logPrefix+"Order is no longer pending, status left unchanged", "order_id", paymentMsg.OrderID)
+		default:
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit order status: %w", err)
+	}
+
+	if statusUpdated {
+		slog.Info(logPrefix+"Order status updated to paid", "order_id", paymentMsg.OrderID)
+	}
+
+	if settings.IdempotencyCheck {
+		strategy := settings.strategy
+		acquired, err := strategy.Acquire(ctx, paymentMsg.OrderID)
+		if err != nil {
+			return fmt.Errorf("idempotency check failed with strategy %s: %w", strategy.Name(), err)
+		}
+
+		if !acquired {
+			slog.Info(logPrefix+"Order already processed for fulfillment", "order_id", paymentMsg.OrderID, "strategy", strategy.Name())
+			s.recordDuplicate(ctx, logPrefix, paymentMsg.OrderID, paymentMsg.MessageID, audit.LayerStrategy, strategy.Name())
+			return s.completeInbox(ctx, paymentMsg.MessageID)
+		}
+	} else {
+		slog.Warn(logPrefix + "Idempotency check is disabled, release the kraken!!")
+	}
+
+	if err := settings.faults.Hit(faults.OrderAfterClaim, settings.rand); err != nil {
+		return err
+	}
+
+	go s.processFulfillment(paymentMsg.OrderID, correlationID)
+
+	if err := settings.faults.Hit(faults.OrderBeforeAck, settings.rand); err != nil {
+		return err
+	}
+	return s.completeInbox(ctx, paymentMsg.MessageID)
+}
+
+func (s *Server) recordDuplicate(ctx context.Context, logPrefix string, orderID string, messageID string, layer string, detail string) {
+	if err := audit.RecordDuplicate(ctx, s.db, orderID, messageID, layer, detail); err != nil {
+		slog.Error(logPrefix+"Failed to record duplicate", "layer", layer, "error", err)
+	}
+}
+
+func (s *Server) completeInbox(ctx context.Context, messageID string) error {
+	if messageID == "" {
+		return nil
+	}
+	return inbox.Complete(ctx, s.db, messageID)
+}
+
+func (s *Server) processFulfillment(orderID string, correlationID string) {
+	logPrefix := "[" + correlationID + "] "
+	settings := s.settings.Load()
+
+	var order models.Order
+	query := `SELECT id, amount, destination_phone, idempotency_key FROM internal_orders WHERE id = ?`
+	if err := s.db.QueryRow(query, orderID).Scan(&order.ID, &order.Amount, &order.DestinationPhone, &order.IdempotencyKey); err != nil {
+		slog.Error(logPrefix+"Failed to get order for fulfillment", "error", err)
+		return
+	}
+
+	fulfillmentReq := models.ExternalFulfillmentRequest{
+		OrderID:          order.ID,
+		DestinationPhone: order.DestinationPhone,
+		Amount:           order.Amount,
+		CorrelationID:    correlationID,
+	}
+
+	var attemptNumber int
+	query = `SELECT COUNT(*) FROM fulfillment_attempts WHERE order_id = ?`
+	if err := s.db.QueryRow(query, orderID).Scan(&attemptNumber); err != nil {
+		attemptNumber = 1
+	} else {
+		attemptNumber++
+	}
+
+	slog.Info(logPrefix+"Processing fulfillment attempt no. "+strconv.Itoa(attemptNumber), "order_id", orderID)
+
+	fulfillmentPayload, _ := json.Marshal(fulfillmentReq)
+	payloadStr := string(fulfillmentPayload)
+
+	var attemptID int64
+	query = `INSERT INTO fulfillment_attempts (order_id, attempt_number, payload) VALUES (?, ?, ?)`
+	if result, err := s.db.Exec(query, orderID, attemptNumber, payloadStr); err != nil {
+		slog.Error(logPrefix+"Failed to insert fulfillment attempt", "error", err)
+	} else {
+		attemptID, _ = result.LastInsertId()
+	}
+
+	if !s.markClaim(orderID, idempotency.ClaimDispatched, logPrefix) {
+		s.recordAttemptOutcome(attemptID, attemptAborted, "fulfillment claim lost", logPrefix)
+		return
+	}
+
+	err := orderstate.Apply(context.Background(), s.db, orderID, orderstate.Paid, orderstate.Fulfilment, "dispatching to vendor")
+	if errors.Is(err, orderstate.ErrStaleStatus) {
+		if settings.IdempotencyCheck {
+			slog.Info(logPrefix+"Order is no longer paid, another dispatch owns it", "order_id", orderID)
+			s.recordAttemptOutcome(attemptID, attemptAborted, "order is no longer paid", logPrefix)
+			s.markClaim(orderID, idempotency.ClaimFailed, logPrefix)
+			return
+		}
+		slog.Warn(logPrefix+"Order is no longer paid, dispatching anyway", "order_id", orderID)
+	} else if err != nil {
+		slog.Error(logPrefix+"Failed to update order status to fulfilment", "error", err)
+		s.recordAttemptOutcome(attemptID, attemptAborted, err.Error(), logPrefix)
+		s.markClaim(orderID, idempotency.ClaimFailed, logPrefix)
+		return
+	}
+
+	slog.Info(logPrefix+"Calling external fulfillment service", "order_id", orderID, "idempotency_key", order.IdempotencyKey)
+
+	headers := map[string]string{
+		idempotency.HeaderKey:      idempotency.FormatKey(order.IdempotencyKey),
+		idempotency.HeaderClientID: "internal-order",
+	}
+
+	timeout := settings.vendorTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client := httpclient.NewClient(timeout)
+	resp, err := client.PostJSONWithHeaders(ctx, s.vendorURL(settings)+"/process-order", fulfillmentReq, headers)
+	if err != nil {
+		slog.Error(logPrefix+"Failed to call external fulfillment, outcome unknown", "error", err, "attempt_number", attemptNumber)
+		s.recordAttemptOutcome(attemptID, attemptUnknown, err.Error(), logPrefix)
+		s.markUnknown(orderID, "vendor call failed: "+err.Error(), logPrefix)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get(idempotency.HeaderReplayed) == "true" {
+		slog.Info(logPrefix+"External fulfillment replayed a stored result", "order_id", orderID)
+		s.recordDuplicate(context.Background(), logPrefix, orderID, "", audit.LayerVendor, "Idempotency-Key "+order.IdempotencyKey)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		slog.Info(logPrefix+"External fulfillment is still processing the order, outcome unknown", "order_id", orderID)
+		s.recordAttemptOutcome(attemptID, attemptInFlight, "", logPrefix)
+		s.markUnknown(orderID, "vendor still processing", logPrefix)
+		return
+	default:
+		var problem models.ProblemDetails
+		json.NewDecoder(resp.Body).Decode(&problem)
+		result := vendorResult{
+			Error:     sql.NullString{String: fmt.Sprintf("HTTP %d %s", resp.StatusCode, problem.Title), Valid: true},
+			Retryable: resp.StatusCode >= http.StatusInternalServerError,
+		}
+		s.recordAttemptOutcome(attemptID, vendorStatusError, result.Error.String, logPrefix)
+		s.settleVendorResult(orderID, orderstate.Fulfilment, vendorStatusError, result, logPrefix)
+		return
+	}
+
+	status, result, err := decodeVendorResponse(resp.Body)
+	if err != nil {
+		slog.Error(logPrefix+"Failed to decode external fulfillment response, outcome unknown", "error", err)
+		s.recordAttemptOutcome(attemptID, attemptUnknown, err.Error(), logPrefix)
+		s.markUnknown(orderID, "undecodable vendor response", logPrefix)
+		return
+	}
+
+	if status == vendorStatusSuccess {
+		if err := settings.faults.Hit(faults.OrderAfterVendorSuccess, settings.rand); err != nil {
+			slog.Error(logPrefix+"Lost external fulfillment result, outcome unknown", "error", err)
+			s.recordAttemptOutcome(attemptID, attemptUnknown, err.Error(), logPrefix)
+			s.markUnknown(orderID, "vendor result lost: "+err.Error(), logPrefix)
+			return
+		}
+	}
+
+	s.recordAttemptOutcome(attemptID, status, result.Error.String, logPrefix)
+	s.settleVendorResult(orderID, orderstate.Fulfilment, status, result, logPrefix)
+	slog.Info(logPrefix+"Order fulfillment processed", "order_id", orderID, "attempt_number", attemptNumber, "vendor_status", status)
+}
+
+const (
+	vendorStatusSuccess    = "success"
+	vendorStatusError      = "error"
+	vendorStatusProcessing = "processing"
+)
+
+type vendorResult struct {
+	OrderID     sql.NullInt64
+	ProcessedAt sql.NullTime
+	Error       sql.NullString
+	Retryable   bool
+}
+
+func decodeVendorResponse(body io.Reader) (string, vendorResult, error) {
+	data := &models.SuccessData{}
+	fulfillmentResp := models.ExternalFulfillmentResponse{Data: data}
+	if err := json.NewDecoder(body).Decode(&fulfillmentResp); err != nil {
+		return "", vendorResult{}, err
+	}
+
+	var result vendorResult
+	switch fulfillmentResp.Status {
+	case vendorStatusSuccess:
+		result.OrderID = sql.NullInt64{Int64: int64(data.VendorOrderID), Valid: true}
+		processedAt, err := time.Parse(models.VendorTimeLayout, data.ProcessedAt)
+		if err != nil {
+			return "", vendorResult{}, fmt.Errorf("invalid processed_at %q: %w", data.ProcessedAt, err)
+		}
+		result.ProcessedAt = sql.NullTime{Time: processedAt, Valid: true}
+	case vendorStatusError:
+		vendorError := fulfillmentResp.Error
+		if fulfillmentResp.ErrorCode != "" {
+			vendorError = fulfillmentResp.ErrorCode + ": " + vendorError
+		}
+		result.Error = sql.NullString{String: vendorError, Valid: true}
+		result.Retryable = fulfillmentResp.Retryable
+	}
+	return fulfillmentResp.Status, result, nil
+}
+
+// settleVendorResult finishes an order from a vendor result, whether it came
+// back from the dispatch itself or from a status inquiry.
+func (s *Server) settleVendorResult(orderID string, from string, status string, result vendorResult, logPrefix string) {
+	switch status {
+	case vendorStatusSuccess:
+		s.finishFulfillment(orderID, from, orderstate.Completed, result, logPrefix)
+		s.markClaim(orderID, idempotency.ClaimDone, logPrefix)
+	case vendorStatusError:
+		slog.Info(logPrefix+"External fulfillment returned an error", "order_id", orderID, "error", result.Error.String, "retryable", result.Retryable)
+		s.finishFulfillment(orderID, from, orderstate.Failed, result, logPrefix)
+		s.markClaim(orderID, idempotency.ClaimFailed, logPrefix)
+	default:
+		slog.Info(logPrefix+"External fulfillment has not settled the order", "order_id", orderID, "vendor_status", status)
+	}
+}
+
+// finishFulfillment stores the vendor result and moves the order to its final
+// status in one transaction. If another dispatch already finished the order,
+// this result is dropped.
+func (s *Server) finishFulfillment(orderID string, from string, to string, result vendorResult, logPrefix string) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error(logPrefix+"Failed to begin transaction", "error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE internal_orders SET vendor_order_id = ?, vendor_processed_at = ?, vendor_error = ?, retryable = ?, next_retry_at = NULL WHERE id = ?`
+	if _, err := tx.ExecContext(ctx, query, result.OrderID, result.ProcessedAt, result.Error, result.Retryable, orderID); err != nil {
+		slog.Error(logPrefix+"Failed to store vendor result", "error", err)
+		return
+	}
+
+	if to == orderstate.Failed && result.Retryable {
+		if err := s.scheduleBackoff(ctx, tx, orderID, logPrefix); err != nil {
+			slog.Error(logPrefix+"Failed to schedule fulfilment retry", "error", err)
+			return
+		}
+	}
+
+	reason := "vendor success"
+	if to == orderstate.Failed {
+		reason = "vendor error: " + result.Error.String
+	}
+	err = orderstate.Transition(ctx, tx, orderID, from, to, reason)
+	if errors.Is(err, orderstate.ErrStaleStatus) {
+		slog.Info(logPrefix+"Order already left "+from+", vendor result dropped", "order_id", orderID, "status", to)
+		return
+	}
+	if err != nil {
+		slog.Error(logPrefix+"Failed to update order status", "status", to, "error", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error(logPrefix+"Failed to commit vendor result", "error", err)
+		return
+	}
+	slog.Info(logPrefix+"Order status updated to "+to, "order_id", orderID)
+}
+
+// markUnknown parks an order whose vendor outcome could not be read. The
+// retry worker resolves it later through the vendor's status inquiry.
+func (s *Server) markUnknown(orderID string, reason string, logPrefix string) {
+	ctx := context.Background()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error(logPrefix+"Failed to begin transaction", "error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := orderstate.Transition(ctx, tx, orderID, orderstate.Fulfilment, orderstate.Unknown, reason); err != nil {
+		slog.Error(logPrefix+"Failed to update order status to unknown", "error", err)
+		return
+	}
+	if err := s.scheduleBackoff(ctx, tx, orderID, logPrefix); err != nil {
+		slog.Error(logPrefix+"Failed to schedule status inquiry", "error", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error(logPrefix+"Failed to commit unknown status", "error", err)
+	}
+}
+
+func (s *Server) markClaim(orderID string, status string, logPrefix string) bool {
+	settings := s.settings.Load()
+	tracker, ok := settings.strategy.(idempotency.Tracker)
+	if !settings.IdempotencyCheck || !ok {
+		return true
+	}
+
+	if err := tracker.Mark(context.Background(), orderID, status); err != nil {
+		slog.Error(logPrefix+"Failed to mark fulfillment claim", "order_id", orderID, "status", status, "error", err)
+		return false
+	}
+	return true
+}
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,104 @@
+package internalorder
+
+import (
+	"fmt"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/faults"
+	"substack-idempotency/pkg/idempotency"
+	"substack-idempotency/pkg/nats"
+	"substack-idempotency/pkg/utils"
+)
+
+// Settings are the parts of the configuration that can be changed at runtime
+// through /admin/config.
+type Settings struct {
+	IdempotencyCheck    bool        `json:"idempotency_check"`
+	IdempotencyStrategy string      `json:"idempotency_strategy"`
+	VendorTimeoutMs     int         `json:"vendor_timeout_ms"`
+	MaxRetries          int         `json:"max_retries"`
+	Faults              string      `json:"faults"`
+	ViaProxy            bool        `json:"via_proxy"`
+	NATS                nats.Faults `json:"nats"`
+	Seed                int64       `json:"seed"`
+
+	strategy idempotency.Strategy
+	faults   faults.Set
+	rand     *utils.Rand
+}
+
+func (s Settings) vendorTimeout() time.Duration {
+	return time.Duration(s.VendorTimeoutMs) * time.Millisecond
+}
+
+// vendorURL is where internal-order reaches the vendor: directly, or through
+// the chaos proxy in front of it.
+func (s *Server) vendorURL(settings *Settings) string {
+	if settings.ViaProxy {
+		return s.cfg.Proxy.URL
+	}
+	return s.cfg.Vendor.URL
+}
+
+func (s *Server) newSettings() (*admin.Settings[Settings], error) {
+	initial := Settings{
+		IdempotencyCheck:    s.cfg.Order.IdempotencyCheck,
+		IdempotencyStrategy: s.cfg.Order.IdempotencyStrategy,
+		VendorTimeoutMs:     int(s.cfg.Order.VendorTimeout.Milliseconds()),
+		MaxRetries:          s.cfg.Order.MaxRetries,
+		Faults:              s.cfg.Order.Faults,
+		ViaProxy:            s.cfg.Order.ViaProxy,
+		NATS:                s.cfg.NATS.Faults(),
+		Seed:                s.cfg.Random.Seed,
+	}
+	return admin.NewSettings("internal-order", initial, s.prepareSettings)
+}
+
+func (s *Server) prepareSettings(settings *Settings) error {
+	if settings.VendorTimeoutMs <= 0 {
+		return fmt.Errorf("vendor_timeout_ms must be positive")
+	}
+	if settings.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+
+	if err := settings.NATS.Validate(); err != nil {
+		return err
+	}
+	armed, err := faults.Parse(settings.Faults, faults.OrderPoints)
+	if err != nil {
+		return err
+	}
+	strategy, err := s.strategyFor(settings.IdempotencyStrategy)
+	if err != nil {
+		return err
+	}
+	settings.strategy = strategy
+	settings.faults = armed
+	settings.rand = utils.NewRand(settings.Seed)
+	settings.NATS.Rand = settings.rand
+	return nil
+}
+
+// natsFaults gives the NATS client the faults of the current settings.
+func (s *Server) natsFaults() nats.Faults {
+	return s.settings.Load().NATS
+}
+
+// strategyFor keeps one instance per strategy, so switching back and forth
+// keeps the in-process state of strategies such as singleflight.
+func (s *Server) strategyFor(name string) (idempotency.Strategy, error) {
+	s.strategiesMu.Lock()
+	defer s.strategiesMu.Unlock()
+
+	if strategy, ok := s.strategies[name]; ok {
+		return strategy, nil
+	}
+	strategy, err := idempotency.New(name, s.db, s.cfg.Order.ClaimLease)
+	if err != nil {
+		return nil, err
+	}
+	s.strategies[name] = strategy
+	return strategy, nil
+}
@@ -0,0 +1,227 @@
+package internalpayment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/config"
+	"substack-idempotency/pkg/database"
+	"substack-idempotency/pkg/faults"
+	"substack-idempotency/pkg/httpserver"
+	"substack-idempotency/pkg/models"
+	"substack-idempotency/pkg/nats"
+	"substack-idempotency/pkg/outbox"
+	"substack-idempotency/pkg/utils"
+)
+
+type Server struct {
+	cfg      config.Config
+	settings *admin.Settings[Settings]
+	db       *sql.DB
+	nats     *nats.Client
+	listener net.Listener
+}
+
+// NewServer connects to the database and NATS, creates the tables and the
+// payment stream, and binds cfg.Payment.Addr. Run releases all of them on exit.
+func NewServer(cfg config.Config) (*Server, error) {
+	db, err := database.Open(database.Config(cfg.Database))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{cfg: cfg, db: db}
+	if err := s.init(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Server) init() error {
+	if err := database.Migrate(s.db); err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+
+	var err error
+	s.settings, err = s.newSettings()
+	if err != nil {
+		return err
+	}
+
+	s.nats, err = nats.Connect(s.cfg.NATS.URL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	s.nats.Faults = s.natsFaults
+
+	streamCfg := nats.StreamConfig{
+		Name:       s.cfg.NATS.Stream,
+		Subjects:   nats.PaymentSubjects,
+		Duplicates: s.cfg.NATS.DuplicateWindow,
+	}
+	if err := s.nats.EnsureStream(streamCfg); err != nil {
+		return fmt.Errorf("failed to ensure NATS stream: %w", err)
+	}
+
+	s.listener, err = net.Listen("tcp", s.cfg.Payment.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.Payment.Addr, err)
+	}
+	return nil
+}
+
+// Close releases the handles NewServer opened. Run calls it on exit.
+func (s *Server) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.nats != nil {
+		s.nats.Close()
+	}
+	s.db.Close()
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	defer s.Close()
+
+	relay := outbox.NewRelay(s.db, s.publish, s.cfg.Payment.OutboxPoll, 100)
+	go relay.Run(ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/trigger-payment-paid", s.triggerPaymentPaid)
+	mux.HandleFunc("/health", healthCheck)
+	admin.Register(mux, s.cfg.Admin.Token, s.settings)
+
+	slog.Info("Internal Payment Service starting on " + s.listener.Addr().String())
+	return httpserver.Serve(ctx, s.listener, mux)
+}
+
+func (s *Server) triggerPaymentPaid(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.PaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.CorrelationID == "" {
+		req.CorrelationID = utils.GenerateCorrelationID()
+	}
+
+	correlationID := req.CorrelationID
+	logPrefix := "[" + correlationID + "] "
+
+	slog.Info(logPrefix+"Processing payment", "order_id", req.OrderID, "amount", req.PaidAmount)
+
+	settings := s.settings.Load()
+	time.Sleep(settings.paymentTimeout())
+
+	slog.Info(logPrefix + "Calling internal order api for validation, result: success")
+
+	publishCount := utils.DeterminePublishCount(settings.rand)
+
+	paidAt := time.Now()
+	message := models.PaymentPaidMessage{
+		MessageID:     utils.GenerateUUID7(),
+		OrderID:       req.OrderID,
+		PaidAmount:    req.PaidAmount,
+		PaidAt:        paidAt,
+		CorrelationID: correlationID,
+	}
+
+	slog.Info(logPrefix+"Publish count", "count", publishCount)
+
+	// The client may already have timed out, but the payment still has to be
+	// recorded, so this must not use the request context.
+	ctx := context.Background()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error(logPrefix+"Failed to begin transaction", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO internal_payments (order_id, paid_amount, paid_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE order_id = order_id`
+	if _, err := tx.ExecContext(ctx, query, req.OrderID, req.PaidAmount, paidAt); err != nil {
+		slog.Error(logPrefix+"Failed to store payment", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// With publisher-side dedupe every copy, and every retried trigger for the
+	// same order, carries the same Nats-Msg-Id, so JetStream keeps only the
+	// first one seen within the stream's duplicate window.
+	var dedupeID string
+	if settings.PublishDedupe {
+		dedupeID = "payment.paid:" + req.OrderID
+	}
+
+	messageData, _ := json.Marshal(message)
+	for i := 0; i < publishCount; i++ {
+		outboxMsg := outbox.Message{
+			OrderID:  req.OrderID,
+			Subject:  "payment.paid",
+			DedupeID: dedupeID,
+			Payload:  messageData,
+		}
+		if err := outbox.Enqueue(ctx, tx, outboxMsg); err != nil {
+			slog.Error(logPrefix+"Failed to queue message", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := settings.faults.Hit(faults.PaymentBeforeCommit, settings.rand); err != nil {
+		slog.Error(logPrefix+"Failed to commit payment", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error(logPrefix+"Failed to commit payment", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info(logPrefix+"Queued to payment.paid outbox", "order_id", req.OrderID, "paid_amount", req.PaidAmount, "paid_at", paidAt, "count", publishCount)
+
+	if err := settings.faults.Hit(faults.PaymentAfterCommit, settings.rand); err != nil {
+		slog.Error(logPrefix+"Failed to respond", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := models.PaymentResponse{Status: "success"}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// publish is the outbox relay's PublishFunc. A fault after a successful
+// publish leaves the row pending, so the relay publishes it again.
+func (s *Server) publish(subject string, dedupeID string, data []byte) (bool, error) {
+	duplicate, err := s.nats.PublishJS(subject, dedupeID, data)
+	if err != nil {
+		return duplicate, err
+	}
+	settings := s.settings.Load()
+	return duplicate, settings.faults.Hit(faults.PaymentAfterPublish, settings.rand)
+}
+
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
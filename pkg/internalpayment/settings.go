@@ -0,0 +1,61 @@
+package internalpayment
+
+import (
+	"fmt"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/faults"
+	"substack-idempotency/pkg/nats"
+	"substack-idempotency/pkg/utils"
+)
+
+// Settings are the parts of the configuration that can be changed at runtime
+// through /admin/config.
+type Settings struct {
+	PaymentTimeoutMs int         `json:"payment_timeout_ms"`
+	PublishDedupe    bool        `json:"publish_dedupe"`
+	Faults           string      `json:"faults"`
+	NATS             nats.Faults `json:"nats"`
+	Seed             int64       `json:"seed"`
+
+	faults faults.Set
+	rand   *utils.Rand
+}
+
+func (s Settings) paymentTimeout() time.Duration {
+	return time.Duration(s.PaymentTimeoutMs) * time.Millisecond
+}
+
+func (s *Server) newSettings() (*admin.Settings[Settings], error) {
+	initial := Settings{
+		PaymentTimeoutMs: int(s.cfg.Payment.Timeout.Milliseconds()),
+		PublishDedupe:    s.cfg.Payment.PublishDedupe,
+		Faults:           s.cfg.Payment.Faults,
+		NATS:             s.cfg.NATS.Faults(),
+		Seed:             s.cfg.Random.Seed,
+	}
+	return admin.NewSettings("internal-payment", initial, prepareSettings)
+}
+
+func prepareSettings(settings *Settings) error {
+	if settings.PaymentTimeoutMs < 0 {
+		return fmt.Errorf("payment_timeout_ms must not be negative")
+	}
+	if err := settings.NATS.Validate(); err != nil {
+		return err
+	}
+	armed, err := faults.Parse(settings.Faults, faults.PaymentPoints)
+	if err != nil {
+		return err
+	}
+	settings.faults = armed
+	settings.rand = utils.NewRand(settings.Seed)
+	settings.NATS.Rand = settings.rand
+	return nil
+}
+
+// natsFaults gives the NATS client the faults of the current settings.
+func (s *Server) natsFaults() nats.Faults {
+	return s.settings.Load().NATS
+}
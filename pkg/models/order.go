@@ -11,9 +11,13 @@ type Order struct {
 	DestinationPhone string    `json:"destination_phone"`
 	Total            int       `json:"total"`
 	Status           string    `json:"status"`
+	IdempotencyKey   string    `json:"idempotency_key"`
+	RunID            string    `json:"run_id,omitempty"`
 	CreatedAt        time.Time `json:"created_at"`
 }
 
+const HeaderRunID = "X-Run-Id"
+
 type CreateOrderResponse struct {
 	ID               string `json:"id"`
 	Status           string `json:"status"`
@@ -35,6 +39,7 @@ type PaymentResponse struct {
 }
 
 type PaymentPaidMessage struct {
+	MessageID     string    `json:"message_id"`
 	OrderID       string    `json:"order_id"`
 	PaidAmount    int       `json:"paid_amount"`
 	PaidAt        time.Time `json:"paid_at"`
@@ -49,11 +54,31 @@ type ExternalFulfillmentRequest struct {
 }
 
 type ExternalFulfillmentResponse struct {
-	Status string      `json:"status"`
-	Error  string      `json:"error"`
-	Data   interface{} `json:"data"`
+	Status    string      `json:"status"`
+	Error     string      `json:"error"`
+	ErrorCode string      `json:"error-code,omitempty"`
+	Retryable bool        `json:"retryable,omitempty"`
+	Data      interface{} `json:"data"`
 }
 
+const (
+	ErrorCodeInvalidNumber       = "INVALID_NUMBER"
+	ErrorCodeInsufficientBalance = "INSUFFICIENT_BALANCE"
+	ErrorCodeVendorBusy          = "VENDOR_BUSY"
+	ErrorCodeOperatorDown        = "OPERATOR_DOWN"
+)
+
+type ProblemDetails struct {
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	Status         int    `json:"status"`
+	Detail         string `json:"detail,omitempty"`
+	OrderID        string `json:"order-id,omitempty"`
+	IdempotencyKey string `json:"idempotency-key,omitempty"`
+}
+
+const VendorTimeLayout = "2006-01-02 15:04:05.000 -07:00"
+
 type SuccessData struct {
 	OrderID       string `json:"order-id"`
 	VendorOrderID int    `json:"vendor-order-id"`
@@ -63,10 +88,15 @@ type SuccessData struct {
 type ExtOrder struct {
 	ID               int       `json:"id"`
 	OrderID          string    `json:"order_id"`
+	ClientID         string    `json:"client_id"`
+	IdempotencyKey   string    `json:"idempotency_key"`
 	DestinationPhone string    `json:"destination_phone"`
 	Amount           int       `json:"amount"`
+	RequestHash      string    `json:"request_hash"`
 	Status           string    `json:"status"`
 	Error            string    `json:"error"`
+	ErrorCode        string    `json:"error_code"`
+	Retryable        bool      `json:"retryable"`
 	ProcessedAt      time.Time `json:"processed_at"`
 }
 
@@ -0,0 +1,198 @@
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"substack-idempotency/pkg/utils"
+
+	"github.com/nats-io/nats.go"
+)
+
+// pausePoll is how often a paused consumer checks whether it was resumed.
+const pausePoll = 200 * time.Millisecond
+
+// headerDuplicate marks a copy republished by the duplicate fault, so the
+// copy is not duplicated again.
+const headerDuplicate = "Nats-Fault-Duplicate"
+
+var ErrPartitioned = errors.New("nats: partitioned by fault injection")
+
+// Faults are network faults injected on a Client's publishes and deliveries.
+// Rates are percentages, rolled for every publish and every delivered
+// message:
+//   - delay hands the message over DelayMs late, in order
+//   - reorder holds the message back for DelayMs while later ones go first;
+//     a held publish reports success straight away
+//   - drop loses it: a publish is not sent and fails with a timeout, a
+//     delivery is neither handled nor acked, so JetStream redelivers it after
+//     AckWait
+//   - duplicate publishes it twice, or republishes a delivered message with
+//     the same headers, Nats-Msg-Id included, as a redundant publisher would.
+//     The stream's duplicate window drops the copy when the message has an
+//     id; otherwise it is stored and delivered as a message of its own
+//
+// Paused cuts the client off: publishes fail, consumers stop fetching and
+// core subscriptions hold their messages until it is cleared, so the backlog
+// arrives late in one go.
+type Faults struct {
+	DelayMs       int  `json:"delay_ms"`
+	DelayRate     int  `json:"delay_rate"`
+	ReorderRate   int  `json:"reorder_rate"`
+	DropRate      int  `json:"drop_rate"`
+	DuplicateRate int  `json:"duplicate_rate"`
+	Paused        bool `json:"paused"`
+
+	Rand *utils.Rand `json:"-"`
+}
+
+func (f Faults) Validate() error {
+	if f.DelayMs < 0 {
+		return fmt.Errorf("nats delay_ms must not be negative")
+	}
+	rates := map[string]int{
+		"delay_rate":     f.DelayRate,
+		"reorder_rate":   f.ReorderRate,
+		"drop_rate":      f.DropRate,
+		"duplicate_rate": f.DuplicateRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 100 {
+			return fmt.Errorf("nats %s must be between 0 and 100, got %d", name, rate)
+		}
+	}
+	return nil
+}
+
+func (f Faults) delay() time.Duration {
+	return time.Duration(f.DelayMs) * time.Millisecond
+}
+
+func (f Faults) hit(rate int) bool {
+	return rate > 0 && f.Rand.Intn(100) < rate
+}
+
+func (c *Client) faults() Faults {
+	if c.Faults == nil {
+		return Faults{}
+	}
+	return c.Faults()
+}
+
+// publishFunc sends one message and reports whether JetStream dropped it as
+// a duplicate.
+type publishFunc func() (bool, error)
+
+// publish runs send through the publish faults. send may be called twice
+// when the message is duplicated.
+func (c *Client) publish(subject string, send publishFunc) (bool, error) {
+	f := c.faults()
+	if f.Paused {
+		return false, ErrPartitioned
+	}
+	if f.hit(f.DropRate) {
+		slog.Warn("NATS fault: dropping publish", "subject", subject)
+		return false, nats.ErrTimeout
+	}
+	if f.hit(f.ReorderRate) {
+		slog.Warn("NATS fault: holding publish back", "subject", subject, "delay", f.delay())
+		time.AfterFunc(f.delay(), func() {
+			if _, err := sendWithDuplicate(subject, send, f); err != nil {
+				slog.Error("NATS fault: held publish failed", "subject", subject, "error", err)
+			}
+		})
+		return false, nil
+	}
+	if f.hit(f.DelayRate) {
+		slog.Warn("NATS fault: delaying publish", "subject", subject, "delay", f.delay())
+		time.Sleep(f.delay())
+	}
+	return sendWithDuplicate(subject, send, f)
+}
+
+func sendWithDuplicate(subject string, send publishFunc, f Faults) (bool, error) {
+	duplicate, err := send()
+	if err != nil || !f.hit(f.DuplicateRate) {
+		return duplicate, err
+	}
+	slog.Warn("NATS fault: duplicating publish", "subject", subject)
+	if _, err := send(); err != nil {
+		return duplicate, err
+	}
+	return duplicate, nil
+}
+
+// deliver runs msg through the delivery faults on its way to handler.
+func (c *Client) deliver(msg *nats.Msg, handler nats.MsgHandler) {
+	f := c.faults()
+	if f.hit(f.DropRate) {
+		slog.Warn("NATS fault: dropping delivery", "subject", msg.Subject)
+		return
+	}
+	if f.hit(f.ReorderRate) {
+		slog.Warn("NATS fault: holding delivery back", "subject", msg.Subject, "delay", f.delay())
+		time.AfterFunc(f.delay(), func() {
+			c.handle(msg, handler, f)
+		})
+		return
+	}
+	if f.hit(f.DelayRate) {
+		slog.Warn("NATS fault: delaying delivery", "subject", msg.Subject, "delay", f.delay())
+		time.Sleep(f.delay())
+	}
+	c.handle(msg, handler, f)
+}
+
+func (c *Client) handle(msg *nats.Msg, handler nats.MsgHandler, f Faults) {
+	handler(msg)
+	if msg.Header.Get(headerDuplicate) != "" || !f.hit(f.DuplicateRate) {
+		return
+	}
+	slog.Warn("NATS fault: republishing delivered message", "subject", msg.Subject)
+	if err := c.republish(msg); err != nil {
+		slog.Error("NATS fault: republishing delivered message failed", "subject", msg.Subject, "error", err)
+	}
+}
+
+// republish sends a copy of msg the way it arrived: through JetStream for a
+// message from a stream, on the plain connection otherwise.
+func (c *Client) republish(msg *nats.Msg) error {
+	dup := nats.NewMsg(msg.Subject)
+	dup.Data = msg.Data
+	for key, values := range msg.Header {
+		dup.Header[key] = values
+	}
+	dup.Header.Set(headerDuplicate, "true")
+
+	if _, err := msg.Metadata(); err == nil && c.JS != nil {
+		ack, err := c.JS.PublishMsg(dup)
+		if err == nil && ack.Duplicate {
+			slog.Info("NATS fault: republished message dropped by the stream's duplicate window", "subject", msg.Subject, "msg_id", msg.Header.Get(nats.MsgIdHdr))
+		}
+		return err
+	}
+	return c.Conn.PublishMsg(dup)
+}
+
+// waitWhilePaused blocks while the client is partitioned. It reports false if
+// done is closed first.
+func (c *Client) waitWhilePaused(done <-chan struct{}) bool {
+	logged := false
+	for c.faults().Paused {
+		if !logged {
+			slog.Warn("NATS fault: consumer paused")
+			logged = true
+		}
+		select {
+		case <-done:
+			return false
+		case <-time.After(pausePoll):
+		}
+	}
+	if logged {
+		slog.Warn("NATS fault: consumer resumed")
+	}
+	return true
+}
@@ -1,19 +1,74 @@
 package nats
 
 import (
-	"os"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/nats-io/nats.go"
 )
 
-var Conn *nats.Conn
+const (
+	SubjectPaymentPaid    = "payment.paid"
+	SubjectPaymentPaidDLQ = "payment.paid.dlq"
+)
+
+// PaymentSubjects are the subjects stored in the payment stream. Every
+// service that ensures the stream must pass the same list.
+var PaymentSubjects = []string{SubjectPaymentPaid, SubjectPaymentPaidDLQ}
+
+var (
+	Conn *nats.Conn
+	JS   nats.JetStreamContext
+)
+
+type StreamConfig struct {
+	Name       string
+	Subjects   []string
+	Duplicates time.Duration
+}
 
-func Init() error {
-	var err error
-	Conn, err = nats.Connect(os.Getenv("NATS_URL"))
+type ConsumerConfig struct {
+	Stream     string
+	Durable    string
+	Subject    string
+	AckWait    time.Duration
+	MaxDeliver int
+	BatchSize  int
+}
+
+// Client is a connection with its JetStream context. Services running in the
+// same process each hold their own Client; the package-level functions below
+// use the Conn and JS set by Init. Faults, when set, is asked for the faults
+// to inject on every publish and delivery.
+type Client struct {
+	Conn   *nats.Conn
+	JS     nats.JetStreamContext
+	Faults func() Faults
+}
+
+func Connect(url string) (*Client, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Client{Conn: conn, JS: js}, nil
+}
+
+func Init(url string) error {
+	client, err := Connect(url)
 	if err != nil {
 		return err
 	}
+	Conn, JS = client.Conn, client.JS
 	return nil
 }
 
@@ -23,16 +78,199 @@ func Close() {
 	}
 }
 
+func defaultClient() *Client {
+	return &Client{Conn: Conn, JS: JS}
+}
+
 func Publish(subject string, data []byte) error {
-	if Conn == nil {
+	return defaultClient().Publish(subject, data)
+}
+
+func Subscribe(subject string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	return defaultClient().Subscribe(subject, handler)
+}
+
+func PublishJS(subject string, msgID string, data []byte) (bool, error) {
+	return defaultClient().PublishJS(subject, msgID, data)
+}
+
+func PublishJSWithHeaders(subject string, headers map[string]string, data []byte) error {
+	return defaultClient().PublishJSWithHeaders(subject, headers, data)
+}
+
+func EnsureStream(cfg StreamConfig) error {
+	return defaultClient().EnsureStream(cfg)
+}
+
+func Consume(ctx context.Context, cfg ConsumerConfig, handler nats.MsgHandler) error {
+	return defaultClient().Consume(ctx, cfg, handler)
+}
+
+func (c *Client) Close() {
+	if c.Conn != nil {
+		c.Conn.Close()
+	}
+}
+
+func (c *Client) Publish(subject string, data []byte) error {
+	if c.Conn == nil {
 		return nats.ErrConnectionClosed
 	}
-	return Conn.Publish(subject, data)
+	_, err := c.publish(subject, func() (bool, error) {
+		return false, c.Conn.Publish(subject, data)
+	})
+	return err
 }
 
-func Subscribe(subject string, handler nats.MsgHandler) (*nats.Subscription, error) {
-	if Conn == nil {
+// Subscribe is a core NATS subscription. While the client is paused the
+// callback waits, so messages queue up in the subscription's pending buffer
+// and are handled once the pause is cleared. Past the buffer's limits (65536
+// messages or 64MB by default) NATS drops them as a slow consumer.
+func (c *Client) Subscribe(subject string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	if c.Conn == nil {
 		return nil, nats.ErrConnectionClosed
 	}
-	return Conn.Subscribe(subject, handler)
+	return c.Conn.Subscribe(subject, func(msg *nats.Msg) {
+		c.waitWhilePaused(nil)
+		c.deliver(msg, handler)
+	})
+}
+
+// PublishJS publishes through JetStream and waits for the stream to
+// acknowledge that the message is stored. A non-empty msgID is sent as
+// Nats-Msg-Id; the returned bool reports whether the stream dropped the
+// message as a duplicate of one seen within its duplicate window.
+func (c *Client) PublishJS(subject string, msgID string, data []byte) (bool, error) {
+	if c.JS == nil {
+		return false, nats.ErrConnectionClosed
+	}
+
+	var opts []nats.PubOpt
+	if msgID != "" {
+		opts = append(opts, nats.MsgId(msgID))
+	}
+
+	return c.publish(subject, func() (bool, error) {
+		ack, err := c.JS.Publish(subject, data, opts...)
+		if err != nil {
+			return false, err
+		}
+		return ack.Duplicate, nil
+	})
+}
+
+func (c *Client) PublishJSWithHeaders(subject string, headers map[string]string, data []byte) error {
+	if c.JS == nil {
+		return nats.ErrConnectionClosed
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	for key, value := range headers {
+		msg.Header.Set(key, value)
+	}
+
+	_, err := c.publish(subject, func() (bool, error) {
+		_, err := c.JS.PublishMsg(msg)
+		return false, err
+	})
+	return err
+}
+
+func (c *Client) EnsureStream(cfg StreamConfig) error {
+	if c.JS == nil {
+		return nats.ErrConnectionClosed
+	}
+
+	streamCfg := &nats.StreamConfig{
+		Name:       cfg.Name,
+		Subjects:   cfg.Subjects,
+		Storage:    nats.FileStorage,
+		Duplicates: cfg.Duplicates,
+	}
+
+	if _, err := c.JS.StreamInfo(cfg.Name); err != nil {
+		if !errors.Is(err, nats.ErrStreamNotFound) {
+			return fmt.Errorf("failed to get stream info: %w", err)
+		}
+		if _, err := c.JS.AddStream(streamCfg); err != nil {
+			return fmt.Errorf("failed to add stream: %w", err)
+		}
+		return nil
+	}
+
+	if _, err := c.JS.UpdateStream(streamCfg); err != nil {
+		return fmt.Errorf("failed to update stream: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) ensureConsumer(cfg ConsumerConfig) error {
+	consumerCfg := &nats.ConsumerConfig{
+		Durable:       cfg.Durable,
+		FilterSubject: cfg.Subject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       cfg.AckWait,
+		MaxDeliver:    cfg.MaxDeliver,
+		DeliverPolicy: nats.DeliverAllPolicy,
+	}
+
+	if _, err := c.JS.ConsumerInfo(cfg.Stream, cfg.Durable); err != nil {
+		if !errors.Is(err, nats.ErrConsumerNotFound) {
+			return fmt.Errorf("failed to get consumer info: %w", err)
+		}
+		if _, err := c.JS.AddConsumer(cfg.Stream, consumerCfg); err != nil {
+			return fmt.Errorf("failed to add consumer: %w", err)
+		}
+		return nil
+	}
+
+	if _, err := c.JS.UpdateConsumer(cfg.Stream, consumerCfg); err != nil {
+		return fmt.Errorf("failed to update consumer: %w", err)
+	}
+	return nil
+}
+
+// Consume creates or updates a durable pull consumer and fetches from it
+// until ctx is done. The handler owns acking: it must Ack, Nak or Term every
+// message, otherwise the message is redelivered after AckWait. The consumer
+// is bound rather than created by the subscription, so it survives restarts.
+func (c *Client) Consume(ctx context.Context, cfg ConsumerConfig, handler nats.MsgHandler) error {
+	if c.JS == nil {
+		return nats.ErrConnectionClosed
+	}
+
+	if err := c.ensureConsumer(cfg); err != nil {
+		return err
+	}
+
+	sub, err := c.JS.PullSubscribe(cfg.Subject, cfg.Durable, nats.Bind(cfg.Stream, cfg.Durable))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to consumer: %w", err)
+	}
+
+	go func() {
+		defer sub.Unsubscribe()
+
+		for ctx.Err() == nil {
+			if !c.waitWhilePaused(ctx.Done()) {
+				return
+			}
+
+			msgs, err := sub.Fetch(cfg.BatchSize, nats.MaxWait(time.Second))
+			if err != nil {
+				if !errors.Is(err, nats.ErrTimeout) {
+					slog.Error("Failed to fetch messages", "consumer", cfg.Durable, "error", err)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+
+			for _, msg := range msgs {
+				c.deliver(msg, handler)
+			}
+		}
+	}()
+
+	return nil
 }
@@ -0,0 +1,177 @@
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"substack-idempotency/pkg/natstest"
+
+	"github.com/nats-io/nats.go"
+)
+
+const testStream = "PAYMENTS"
+
+func connect(t *testing.T) *Client {
+	t.Helper()
+
+	client, err := Connect(natstest.Start(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	if err := client.EnsureStream(StreamConfig{Name: testStream, Subjects: PaymentSubjects, Duplicates: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// consume starts a consumer that hands every delivery to the returned
+// channel, leaving the ack to the test.
+func consume(t *testing.T, client *Client, cfg ConsumerConfig) <-chan *nats.Msg {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	deliveries := make(chan *nats.Msg, 16)
+	if err := client.Consume(ctx, cfg, func(msg *nats.Msg) {
+		deliveries <- msg
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func receive(t *testing.T, deliveries <-chan *nats.Msg) *nats.Msg {
+	t.Helper()
+
+	select {
+	case msg := <-deliveries:
+		return msg
+	case <-time.After(10 * time.Second):
+		t.Fatal("no delivery within 10s")
+		return nil
+	}
+}
+
+func expectNoDelivery(t *testing.T, deliveries <-chan *nats.Msg, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case msg := <-deliveries:
+		t.Fatalf("unexpected delivery of %q", msg.Data)
+	case <-time.After(wait):
+	}
+}
+
+func numDelivered(t *testing.T, msg *nats.Msg) uint64 {
+	t.Helper()
+
+	meta, err := msg.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta.NumDelivered
+}
+
+func TestPublishJSDropsDuplicateMsgID(t *testing.T) {
+	client := connect(t)
+
+	tests := []struct {
+		name          string
+		msgID         string
+		wantDuplicate bool
+	}{
+		{name: "first publish", msgID: "message-1", wantDuplicate: false},
+		{name: "same id", msgID: "message-1", wantDuplicate: true},
+		{name: "other id", msgID: "message-2", wantDuplicate: false},
+		{name: "no id", msgID: "", wantDuplicate: false},
+		{name: "no id again", msgID: "", wantDuplicate: false},
+	}
+
+	for _, tt := range tests {
+		duplicate, err := client.PublishJS(SubjectPaymentPaid, tt.msgID, []byte(tt.name))
+		if err != nil {
+			t.Fatalf("%s: PublishJS() = %v", tt.name, err)
+		}
+		if duplicate != tt.wantDuplicate {
+			t.Errorf("%s: duplicate = %v, want %v", tt.name, duplicate, tt.wantDuplicate)
+		}
+	}
+
+	info, err := client.JS.StreamInfo(testStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State.Msgs != 4 {
+		t.Errorf("stream holds %d messages, want 4", info.State.Msgs)
+	}
+}
+
+// A handler that fails before its commit does not ack, so the message must
+// come back after AckWait, and stop coming back once it is acked.
+func TestConsumeRedeliversUntilAcked(t *testing.T) {
+	client := connect(t)
+	ackWait := 500 * time.Millisecond
+	deliveries := consume(t, client, ConsumerConfig{
+		Stream:     testStream,
+		Durable:    "redeliver",
+		Subject:    SubjectPaymentPaid,
+		AckWait:    ackWait,
+		MaxDeliver: 5,
+		BatchSize:  1,
+	})
+
+	if _, err := client.PublishJS(SubjectPaymentPaid, "message-1", []byte("paid")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, deliveries)
+	if got := numDelivered(t, first); got != 1 {
+		t.Fatalf("first delivery is no. %d", got)
+	}
+
+	second := receive(t, deliveries)
+	if got := numDelivered(t, second); got != 2 {
+		t.Fatalf("redelivery is no. %d, want 2", got)
+	}
+	if err := second.AckSync(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoDelivery(t, deliveries, 3*ackWait)
+}
+
+// A message that is nakked on every delivery is given up after MaxDeliver
+// deliveries; the handler sees the last one with NumDelivered == MaxDeliver,
+// which is where internal-order dead-letters it.
+func TestConsumeStopsAtMaxDeliver(t *testing.T) {
+	client := connect(t)
+	maxDeliver := 3
+	deliveries := consume(t, client, ConsumerConfig{
+		Stream:     testStream,
+		Durable:    "max-deliver",
+		Subject:    SubjectPaymentPaid,
+		AckWait:    time.Second,
+		MaxDeliver: maxDeliver,
+		BatchSize:  1,
+	})
+
+	if _, err := client.PublishJS(SubjectPaymentPaid, "message-1", []byte("paid")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= maxDeliver; i++ {
+		msg := receive(t, deliveries)
+		if got := numDelivered(t, msg); got != uint64(i) {
+			t.Fatalf("delivery %d has NumDelivered %d", i, got)
+		}
+		if err := msg.Nak(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectNoDelivery(t, deliveries, 2*time.Second)
+}
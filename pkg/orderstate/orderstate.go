@@ -0,0 +1,99 @@
+package orderstate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+const (
+	Pending    = "pending"
+	Paid       = "paid"
+	Fulfilment = "fulfilment"
+	Unknown    = "unknown"
+	Completed  = "completed"
+	Failed     = "failed"
+	Cancelled  = "cancelled"
+	Refunded   = "refunded"
+)
+
+var (
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	ErrStaleStatus       = errors.New("order is no longer in the expected status")
+)
+
+var transitions = map[string][]string{
+	Pending:    {Paid, Cancelled},
+	Paid:       {Fulfilment, Refunded},
+	Fulfilment: {Completed, Failed, Unknown},
+	Unknown:    {Completed, Failed, Paid},
+	Completed:  {Refunded},
+	Failed:     {Paid, Refunded},
+}
+
+func CanTransition(from string, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func IsTerminal(status string) bool {
+	switch status {
+	case Completed, Failed, Cancelled, Refunded:
+		return true
+	default:
+		return false
+	}
+}
+
+// Transition moves an order from one status to another inside tx. The update
+// is a compare-and-set on the current status, so a late or duplicate caller
+// gets ErrStaleStatus instead of moving the order backwards. Every applied
+// transition is written to order_status_history in the same transaction.
+func Transition(ctx context.Context, tx *sql.Tx, orderID string, from string, to string, reason string) error {
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+
+	query := `UPDATE internal_orders SET status = ? WHERE id = ? AND status = ?`
+	result, err := tx.ExecContext(ctx, query, to, orderID, from)
+	if err != nil {
+		return fmt.Errorf("failed to update order status: %w", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to read order status update result: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%w: expected %s", ErrStaleStatus, from)
+	}
+
+	query = `INSERT INTO order_status_history (order_id, from_status, to_status, reason) VALUES (?, ?, ?, ?)`
+	if _, err := tx.ExecContext(ctx, query, orderID, from, to, reason); err != nil {
+		return fmt.Errorf("failed to record order status history: %w", err)
+	}
+	return nil
+}
+
+// Apply runs a single Transition in its own transaction.
+func Apply(ctx context.Context, db *sql.DB, orderID string, from string, to string, reason string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := Transition(ctx, tx, orderID, from, to, reason); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit order status: %w", err)
+	}
+	return nil
+}
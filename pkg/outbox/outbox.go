@@ -0,0 +1,159 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"substack-idempotency/pkg/audit"
+)
+
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+)
+
+// PublishFunc publishes one message. dedupeID is empty unless publisher-side
+// dedupe is on; duplicate reports that the broker dropped the message because
+// it had already seen dedupeID.
+type PublishFunc func(subject string, dedupeID string, data []byte) (duplicate bool, err error)
+
+type Message struct {
+	OrderID  string
+	Subject  string
+	DedupeID string
+	Payload  []byte
+}
+
+func Enqueue(ctx context.Context, tx *sql.Tx, msg Message) error {
+	query := `INSERT INTO payment_outbox (order_id, subject, dedupe_id, payload, status) VALUES (?, ?, ?, ?, ?)`
+	dedupeID := sql.NullString{String: msg.DedupeID, Valid: msg.DedupeID != ""}
+	if _, err := tx.ExecContext(ctx, query, msg.OrderID, msg.Subject, dedupeID, msg.Payload, StatusPending); err != nil {
+		return fmt.Errorf("failed to enqueue outbox message: %w", err)
+	}
+	return nil
+}
+
+// Relay publishes pending outbox rows. Rows are claimed with
+// FOR UPDATE SKIP LOCKED, so several payment instances can run a relay
+// against the same table without publishing the same row concurrently. A
+// relay that dies after publishing but before committing leaves the row
+// pending, so delivery is at-least-once.
+type Relay struct {
+	db        *sql.DB
+	publish   PublishFunc
+	interval  time.Duration
+	batchSize int
+}
+
+func NewRelay(db *sql.DB, publish PublishFunc, interval time.Duration, batchSize int) *Relay {
+	return &Relay{
+		db:        db,
+		publish:   publish,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			relayed, err := r.relayBatch(ctx)
+			if err != nil {
+				slog.Error("Failed to relay outbox batch", "error", err)
+				break
+			}
+			if relayed < r.batchSize {
+				break
+			}
+		}
+	}
+}
+
+type message struct {
+	id       int64
+	orderID  string
+	subject  string
+	dedupeID string
+	payload  []byte
+}
+
+func (r *Relay) relayBatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, order_id, subject, COALESCE(dedupe_id, ''), payload FROM payment_outbox
+			  WHERE status = ?
+			  ORDER BY id ASC
+			  LIMIT ?
+			  FOR UPDATE SKIP LOCKED`
+	rows, err := tx.QueryContext(ctx, query, StatusPending, r.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query outbox: %w", err)
+	}
+
+	var messages []message
+	for rows.Next() {
+		var msg message
+		if err := rows.Scan(&msg.id, &msg.orderID, &msg.subject, &msg.dedupeID, &msg.payload); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan outbox message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read outbox: %w", err)
+	}
+
+	sent := 0
+	for _, msg := range messages {
+		duplicate, err := r.publish(msg.subject, msg.dedupeID, msg.payload)
+		if err != nil {
+			slog.Error("Failed to publish outbox message", "id", msg.id, "subject", msg.subject, "error", err)
+			query := `UPDATE payment_outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?`
+			if _, err := tx.ExecContext(ctx, query, truncate(err.Error(), 255), msg.id); err != nil {
+				return 0, fmt.Errorf("failed to record outbox publish error: %w", err)
+			}
+			continue
+		}
+
+		if duplicate {
+			if err := audit.RecordDuplicate(ctx, tx, msg.orderID, "", audit.LayerBroker, "Nats-Msg-Id "+msg.dedupeID); err != nil {
+				return 0, err
+			}
+		}
+
+		query := `UPDATE payment_outbox SET status = ?, attempts = attempts + 1, sent_at = NOW(3) WHERE id = ?`
+		if _, err := tx.ExecContext(ctx, query, StatusSent, msg.id); err != nil {
+			return 0, fmt.Errorf("failed to mark outbox message sent: %w", err)
+		}
+		sent++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit outbox batch: %w", err)
+	}
+	return sent, nil
+}
+
+func truncate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return s[:maxLen]
+}
@@ -0,0 +1,131 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"substack-idempotency/pkg/chaosproxy"
+	"substack-idempotency/pkg/config"
+	"substack-idempotency/pkg/externalfulfilment"
+	"substack-idempotency/pkg/internalorder"
+	"substack-idempotency/pkg/internalpayment"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"golang.org/x/sync/errgroup"
+)
+
+// Stack is internal-order, internal-payment, external-order-fulfilment and
+// the chaos proxy running in one process against an embedded NATS server
+// with JetStream.
+type Stack struct {
+	nats     *server.Server
+	storeDir string
+	order    *internalorder.Server
+	payment  *internalpayment.Server
+	external *externalfulfilment.Server
+	proxy    *chaosproxy.Server
+}
+
+// New starts the NATS server on a random local port, so it does not clash
+// with the one from docker compose, and creates the services with cfg
+// pointing at it. JetStream keeps its data in a temporary directory that is
+// removed when Run returns, so every stack starts with an empty stream.
+func New(cfg config.Config) (*Stack, error) {
+	storeDir, err := os.MkdirTemp("", "all-in-one-nats-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream store: %w", err)
+	}
+
+	s := &Stack{storeDir: storeDir}
+	if err := s.start(cfg); err != nil {
+		s.shutdown()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Stack) start(cfg config.Config) error {
+	var err error
+	s.nats, err = server.NewServer(&server.Options{
+		ServerName: "all-in-one",
+		Host:       "127.0.0.1",
+		Port:       server.RANDOM_PORT,
+		JetStream:  true,
+		StoreDir:   s.storeDir,
+		NoLog:      true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create NATS server: %w", err)
+	}
+
+	s.nats.Start()
+	if !s.nats.ReadyForConnections(10 * time.Second) {
+		return fmt.Errorf("NATS server not ready")
+	}
+	slog.Info("Embedded NATS server started", "url", s.nats.ClientURL(), "store_dir", s.storeDir)
+
+	cfg.NATS.URL = s.nats.ClientURL()
+
+	s.external, err = externalfulfilment.NewServer(cfg)
+	if err != nil {
+		return fmt.Errorf("external-order-fulfilment: %w", err)
+	}
+	s.proxy, err = chaosproxy.NewServer(cfg)
+	if err != nil {
+		return fmt.Errorf("chaos-proxy: %w", err)
+	}
+	s.order, err = internalorder.NewServer(cfg)
+	if err != nil {
+		return fmt.Errorf("internal-order: %w", err)
+	}
+	s.payment, err = internalpayment.NewServer(cfg)
+	if err != nil {
+		return fmt.Errorf("internal-payment: %w", err)
+	}
+	return nil
+}
+
+// Run serves all the services until ctx is done or one of them fails,
+// then stops the rest and the NATS server.
+func (s *Stack) Run(ctx context.Context) error {
+	defer s.shutdown()
+
+	group, ctx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		return s.external.Run(ctx)
+	})
+	group.Go(func() error {
+		return s.proxy.Run(ctx)
+	})
+	group.Go(func() error {
+		return s.order.Run(ctx)
+	})
+	group.Go(func() error {
+		return s.payment.Run(ctx)
+	})
+	return group.Wait()
+}
+
+func (s *Stack) shutdown() {
+	if s.external != nil {
+		s.external.Close()
+	}
+	if s.proxy != nil {
+		s.proxy.Close()
+	}
+	if s.order != nil {
+		s.order.Close()
+	}
+	if s.payment != nil {
+		s.payment.Close()
+	}
+	if s.nats != nil {
+		s.nats.Shutdown()
+		s.nats.WaitForShutdown()
+	}
+	os.RemoveAll(s.storeDir)
+}
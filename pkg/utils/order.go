@@ -2,7 +2,6 @@ package utils
 
 import (
 	"fmt"
-	"math/rand"
 	"time"
 
 	"substack-idempotency/pkg/models"
@@ -10,9 +9,9 @@ import (
 	"github.com/google/uuid"
 )
 
-func GenerateRandomOrder() models.Order {
+func GenerateRandomOrder(r *Rand) models.Order {
 	operators := []string{"indosat", "xl", "three"}
-	operator := operators[time.Now().UnixNano()%3]
+	operator := operators[r.Intn(3)]
 
 	var adminFee int
 	switch operator {
@@ -25,7 +24,7 @@ func GenerateRandomOrder() models.Order {
 	}
 
 	amounts := []int{1000, 2000, 3000, 4000, 5000, 6000, 7000, 8000, 9000}
-	amount := amounts[time.Now().UnixNano()%9]
+	amount := amounts[r.Intn(9)]
 
 	var phonePrefix string
 	switch operator {
@@ -37,7 +36,7 @@ func GenerateRandomOrder() models.Order {
 		phonePrefix = "0896-000-00"
 	}
 
-	phoneSuffix := fmt.Sprintf("%02d", (time.Now().UnixNano()%99)+1)
+	phoneSuffix := fmt.Sprintf("%02d", r.Intn(99)+1)
 	destinationPhone := phonePrefix + phoneSuffix
 
 	return models.Order{
@@ -49,6 +48,7 @@ func GenerateRandomOrder() models.Order {
 		DestinationPhone: destinationPhone,
 		Total:            amount + adminFee,
 		Status:           "pending",
+		IdempotencyKey:   GenerateUUID7(),
 		CreatedAt:        time.Now(),
 	}
 }
@@ -61,8 +61,7 @@ func GenerateUUID7() string {
 	return u.String()
 }
 
-func DeterminePublishCount() int {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+func DeterminePublishCount(r *Rand) int {
 	chance := r.Intn(100)
 
 	if chance < 70 {
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Rand is a random source that can be shared between goroutines. The
+// services draw every random decision from one, so a run can be repeated
+// with the same seed. A nil *Rand draws from the global source.
+type Rand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewRand returns a source seeded with seed, or with the clock when seed is 0.
+func NewRand(seed int64) *Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Rand{rng: rand.New(rand.NewSource(seed))}
+}
+
+// Intn returns a number in [0, n).
+func (r *Rand) Intn(n int) int {
+	if r == nil {
+		return rand.Intn(n)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Intn(n)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"substack-idempotency/pkg/admin"
+	"substack-idempotency/pkg/httpclient"
+)
+
+const adminTimeout = 5 * time.Second
+
+// adminServiceURL maps the service names accepted on the command line to the
+// base URL of the service's admin API.
+func adminServiceURL(service string) (string, error) {
+	switch service {
+	case "order":
+		return appConfig.Order.URL, nil
+	case "payment":
+		return appConfig.Payment.URL, nil
+	case "vendor":
+		return appConfig.Vendor.URL, nil
+	case "proxy":
+		return appConfig.Proxy.URL, nil
+	}
+	return "", fmt.Errorf("unknown service %q, expected order, payment, vendor or proxy", service)
+}
+
+// configSwitch is one runtime setting change, written as
+// service.setting=value on the command line.
+type configSwitch struct {
+	Service string
+	Setting string
+	Value   interface{}
+}
+
+func (c configSwitch) String() string {
+	return fmt.Sprintf("%s.%s=%v", c.Service, c.Setting, c.Value)
+}
+
+func parseConfigSwitch(arg string) (configSwitch, error) {
+	key, value, ok := strings.Cut(arg, "=")
+	service, setting, hasService := strings.Cut(key, ".")
+	if !ok || !hasService || setting == "" {
+		return configSwitch{}, fmt.Errorf("invalid switch %q, expected service.setting=value", arg)
+	}
+	if _, err := adminServiceURL(service); err != nil {
+		return configSwitch{}, err
+	}
+	return configSwitch{Service: service, Setting: setting, Value: parseSettingValue(value)}, nil
+}
+
+// parseSettingValue keeps the JSON type the services expect: booleans and
+// integers are sent as such, anything else as a string.
+func parseSettingValue(value string) interface{} {
+	if value == "true" || value == "false" {
+		return value == "true"
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return n
+	}
+	return value
+}
+
+// setPatch sets setting in patch. A dotted setting such as nats.paused
+// addresses a field of a nested object.
+func setPatch(patch map[string]interface{}, setting string, value interface{}) {
+	key, rest, nested := strings.Cut(setting, ".")
+	if !nested {
+		patch[key] = value
+		return
+	}
+	child, ok := patch[key].(map[string]interface{})
+	if !ok {
+		child = make(map[string]interface{})
+		patch[key] = child
+	}
+	setPatch(child, rest, value)
+}
+
+// switchFlag collects repeated --switch flags.
+type switchFlag []configSwitch
+
+func (f switchFlag) String() string {
+	parts := make([]string, len(f))
+	for i, c := range f {
+		parts[i] = c.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (f *switchFlag) Set(arg string) error {
+	c, err := parseConfigSwitch(arg)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, c)
+	return nil
+}
+
+// applySwitches sends the switches to their services, one PATCH per service.
+func applySwitches(switches []configSwitch) error {
+	patches := make(map[string]map[string]interface{})
+	for _, c := range switches {
+		if patches[c.Service] == nil {
+			patches[c.Service] = make(map[string]interface{})
+		}
+		setPatch(patches[c.Service], c.Setting, c.Value)
+	}
+
+	services := make([]string, 0, len(patches))
+	for service := range patches {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	for _, service := range services {
+		if _, err := patchAdminConfig(service, patches[service]); err != nil {
+			return err
+		}
+		slog.Info("Admin config changed", "service", service, "patch", patches[service])
+	}
+	return nil
+}
+
+// applySeed sets the seed of every service, which also restarts their random
+// sequences, so a run with the same seed makes the same random decisions. A
+// service that cannot be reached does not stop the others from being seeded.
+func applySeed(seed int64) error {
+	var errs []error
+	for _, service := range []string{"order", "payment", "vendor", "proxy"} {
+		if err := applySwitches([]configSwitch{{Service: service, Setting: "seed", Value: seed}}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func getAdminConfig(service string) (map[string]interface{}, error) {
+	url, err := adminServiceURL(service)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+	defer cancel()
+
+	resp, err := httpclient.NewClient(adminTimeout).GetWithHeaders(ctx, url+admin.Path, adminHeaders())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s admin config: %w", service, err)
+	}
+	return decodeAdminResponse(service, resp)
+}
+
+func patchAdminConfig(service string, patch map[string]interface{}) (map[string]interface{}, error) {
+	url, err := adminServiceURL(service)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+	defer cancel()
+
+	resp, err := httpclient.NewClient(adminTimeout).PatchJSONWithHeaders(ctx, url+admin.Path, patch, adminHeaders())
+	if err != nil {
+		return nil, fmt.Errorf("failed to update %s admin config: %w", service, err)
+	}
+	return decodeAdminResponse(service, resp)
+}
+
+func adminHeaders() map[string]string {
+	return map[string]string{admin.HeaderToken: appConfig.Admin.Token}
+}
+
+func decodeAdminResponse(service string, resp *http.Response) (map[string]interface{}, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s admin API returned %d: %s", service, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var settings map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+		return nil, fmt.Errorf("failed to decode %s admin config: %w", service, err)
+	}
+	return settings, nil
+}
+
+func runAdmin(args []string) {
+	if len(args) < 2 || (args[0] == "set" && len(args) < 3) {
+		fmt.Println("Usage: go run ./tooling admin <command>")
+		fmt.Println("  show <service>                     - Print a service's runtime settings")
+		fmt.Println("  set <service> <setting=value>...   - Change a service's runtime settings")
+		fmt.Println("Services: order, payment, vendor, proxy")
+		os.Exit(1)
+	}
+
+	service := args[1]
+	var settings map[string]interface{}
+	var err error
+
+	switch args[0] {
+	case "show":
+		settings, err = getAdminConfig(service)
+	case "set":
+		patch := make(map[string]interface{})
+		for _, arg := range args[2:] {
+			c, parseErr := parseConfigSwitch(service + "." + arg)
+			if parseErr != nil {
+				fmt.Println(parseErr)
+				os.Exit(1)
+			}
+			setPatch(patch, c.Setting, c.Value)
+		}
+		settings, err = patchAdminConfig(service, patch)
+	default:
+		fmt.Println("Unknown admin command:", args[0])
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Error("Admin request failed", "error", err)
+		os.Exit(1)
+	}
+
+	printAdminConfig(service, settings)
+}
+
+func printAdminConfig(service string, settings map[string]interface{}) {
+	flat := make(map[string]interface{})
+	flattenSettings(flat, "", settings)
+
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	table := NewTable("Runtime settings of " + service)
+	table.AddColumn("Setting", 24, "left", nil)
+	table.AddColumn("Value", 40, "left", nil)
+
+	table.PrintHeader()
+	for _, key := range keys {
+		table.PrintRow([]interface{}{key, truncateString(fmt.Sprint(flat[key]), 40)})
+	}
+	table.PrintFooter()
+}
+
+// flattenSettings names nested settings the way setPatch takes them.
+func flattenSettings(flat map[string]interface{}, prefix string, settings map[string]interface{}) {
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenSettings(flat, prefix+key+".", nested)
+			continue
+		}
+		flat[prefix+key] = value
+	}
+}
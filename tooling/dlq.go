@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"substack-idempotency/pkg/database"
+	"substack-idempotency/pkg/dlq"
+	"substack-idempotency/pkg/nats"
+)
+
+func runDLQ(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: go run ./tooling dlq <list|show <id>|redrive <id>>")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		printDeadLetters()
+	case "show", "redrive":
+		if len(args) < 2 {
+			fmt.Printf("Usage: go run ./tooling dlq %s <id>\n", args[0])
+			os.Exit(1)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Println("Invalid id:", args[1])
+			os.Exit(1)
+		}
+		if args[0] == "show" {
+			showDeadLetter(id)
+		} else {
+			redriveDeadLetter(id)
+		}
+	default:
+		fmt.Println("Unknown dlq command:", args[0])
+		os.Exit(1)
+	}
+}
+
+func printDeadLetters() {
+	jakartaLoc := getJakartaLocation()
+
+	entries, err := dlq.List(context.Background(), database.DB, 100)
+	if err != nil {
+		slog.Error("Failed to list dead letters", "error", err)
+		return
+	}
+
+	table := NewTable("Dead Letters (latest 100)")
+	table.AddColumn("ID", 5, "left", nil)
+	table.AddColumn("Order ID", 38, "left", nil)
+	table.AddColumn("Deliveries", 12, "right", nil)
+	table.AddColumn("Error", 40, "left", nil)
+	table.AddColumn("Created At", 21, "left", nil)
+	table.AddColumn("Redriven", 10, "right", nil)
+
+	table.PrintHeader()
+
+	if len(entries) == 0 {
+		table.PrintEmptyRow("No dead letters")
+	} else {
+		for _, entry := range entries {
+			table.PrintRow([]interface{}{
+				entry.ID,
+				truncateString(entry.OrderID, 36),
+				entry.Deliveries,
+				truncateString(entry.Error, 38),
+				entry.CreatedAt.In(jakartaLoc).Format("2006-01-02 15:04:05"),
+				entry.RedriveCount,
+			})
+		}
+	}
+
+	table.PrintFooter()
+	fmt.Printf("Total dead letters shown: %d\n", len(entries))
+}
+
+func showDeadLetter(id int64) {
+	jakartaLoc := getJakartaLocation()
+
+	entry, err := dlq.Get(context.Background(), database.DB, id)
+	if err != nil {
+		slog.Error("Failed to get dead letter", "id", id, "error", err)
+		return
+	}
+
+	fmt.Printf("ID:            %d\n", entry.ID)
+	fmt.Printf("Subject:       %s\n", entry.Subject)
+	fmt.Printf("Message ID:    %s\n", entry.MessageID)
+	fmt.Printf("Order ID:      %s\n", entry.OrderID)
+	fmt.Printf("Deliveries:    %d\n", entry.Deliveries)
+	fmt.Printf("Error:         %s\n", entry.Error)
+	fmt.Printf("Created At:    %s\n", entry.CreatedAt.In(jakartaLoc).Format("2006-01-02 15:04:05.000"))
+	if entry.RedrivenAt.Valid {
+		fmt.Printf("Redriven At:   %s (%d times)\n", entry.RedrivenAt.Time.In(jakartaLoc).Format("2006-01-02 15:04:05.000"), entry.RedriveCount)
+	}
+
+	var payload bytes.Buffer
+	if err := json.Indent(&payload, entry.Payload, "", "  "); err != nil {
+		fmt.Printf("Payload:\n%s\n", entry.Payload)
+		return
+	}
+	fmt.Printf("Payload:\n%s\n", payload.String())
+}
+
+func redriveDeadLetter(id int64) {
+	ctx := context.Background()
+
+	entry, err := dlq.Get(ctx, database.DB, id)
+	if err != nil {
+		slog.Error("Failed to get dead letter", "id", id, "error", err)
+		return
+	}
+
+	if err := nats.Init(appConfig.NATS.URL); err != nil {
+		slog.Error("Failed to initialize NATS", "error", err)
+		return
+	}
+	defer nats.Close()
+
+	if _, err := nats.PublishJS(entry.Subject, "", entry.Payload); err != nil {
+		slog.Error("Failed to redrive dead letter", "id", id, "error", err)
+		return
+	}
+
+	if err := dlq.MarkRedriven(ctx, database.DB, id); err != nil {
+		slog.Error("Failed to mark dead letter redriven", "id", id, "error", err)
+		return
+	}
+
+	fmt.Printf("Dead letter %d redriven to %s\n", id, entry.Subject)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -10,57 +12,110 @@ import (
 	"sync"
 	"time"
 
+	"substack-idempotency/pkg/config"
 	"substack-idempotency/pkg/database"
 	"substack-idempotency/pkg/httpclient"
 	"substack-idempotency/pkg/models"
+	"substack-idempotency/pkg/orderstate"
 	"substack-idempotency/pkg/utils"
 
 	"github.com/joho/godotenv"
 )
 
+var appConfig config.Config
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <command> [args]")
+	if err := godotenv.Load(); err != nil {
+		slog.Info("No .env file found")
+	}
+
+	cfg, args, err := config.Load("tooling", os.Args[1:])
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	appConfig = cfg
+
+	if len(args) < 1 {
+		fmt.Println("Usage: go run ./tooling [config flags] <command> [args]")
 		fmt.Println("Commands:")
 		fmt.Println("  resetdb                    - Reset all database tables")
-		fmt.Println("  simulator <count>          - Run simulation with specified count")
+		fmt.Println("  simulator <count> [flags]  - Run simulation, wait for orders to settle and print their settlement")
 		fmt.Println("  external-settlement        - Print today's external settlement")
 		fmt.Println("  internal-settlement        - Print today's internal settlement")
-		fmt.Println("  attempt                    - Print fulfillment attempts audit log")
+		fmt.Println("  full-settlement            - Print internal, external and payment settlement with a summary")
+		fmt.Println("  attempt                    - Print fulfillment attempts, inbox and duplicate audit log")
+		fmt.Println("  reconcile [--date D]       - Match internal orders against vendor rows")
+		fmt.Println("  runs list                  - List recorded simulation runs")
+		fmt.Println("  runs show <id>             - Show a run's config and outcome")
+		fmt.Println("  runs compare <id> <id>     - Compare two runs side by side")
+		fmt.Println("  matrix [flags]             - Run every idempotency combination in-process and compare them")
+		fmt.Println("  admin show|set <service>   - Show or change a running service's runtime settings")
+		fmt.Println("  dlq list                   - List dead-lettered messages")
+		fmt.Println("  dlq show <id>              - Inspect a dead-lettered message")
+		fmt.Println("  dlq redrive <id>           - Republish a dead-lettered message")
 		os.Exit(1)
 	}
 
-	if err := godotenv.Load(); err != nil {
-		slog.Info("No .env file found")
-	}
-
-	if err := database.Init(); err != nil {
+	if err := database.Init(database.Config(appConfig.Database)); err != nil {
 		slog.Error("Failed to initialize database", "error", err)
 		os.Exit(1)
 	}
 	defer database.Close()
 
-	command := os.Args[1]
+	command := args[0]
 	switch command {
 	case "resetdb":
 		resetDB()
 	case "simulator":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: go run main.go simulator <count>")
+		if len(args) < 2 {
+			fmt.Println("Usage: go run ./tooling simulator <count> [--wait 60s] [--concurrency 4] [--seed N] [--switch-at N --switch service.setting=value]")
 			os.Exit(1)
 		}
-		count, err := strconv.Atoi(os.Args[2])
+		count, err := strconv.Atoi(args[1])
 		if err != nil {
-			fmt.Println("Invalid count:", os.Args[2])
+			fmt.Println("Invalid count:", args[1])
+			os.Exit(1)
+		}
+		flags := flag.NewFlagSet("simulator", flag.ExitOnError)
+		wait := flags.Duration("wait", 60*time.Second, "How long to wait for the run's orders to settle")
+		concurrency := flags.Int("concurrency", 4, "Number of goroutines running iterations")
+		seed := flags.Int64("seed", time.Now().UnixNano(), "Seed for the services' random decisions, recorded with the run")
+		switchAt := flags.Int("switch-at", 0, "Apply the --switch settings after this many iterations")
+		var switches switchFlag
+		flags.Var(&switches, "switch", "Runtime setting to change mid-run, as service.setting=value (repeatable)")
+		flags.Parse(args[2:])
+		if count < 1 || *concurrency < 1 {
+			fmt.Println("count and --concurrency must be at least 1")
+			os.Exit(1)
+		}
+		if len(switches) > 0 && (*switchAt < 1 || *switchAt >= count) {
+			fmt.Println("--switch-at must be between 1 and count-1 when --switch is given")
 			os.Exit(1)
 		}
-		runSimulator(count)
+		runSimulator(simulatorOptions{Count: count, Concurrency: *concurrency, Seed: *seed, Wait: *wait, SwitchAt: *switchAt, Switches: switches})
 	case "external-settlement":
 		printExternalSettlement()
 	case "internal-settlement":
 		printInternalSettlement()
+	case "full-settlement":
+		printFullSettlement()
 	case "attempt":
 		printAttempt()
+		fmt.Println()
+		printInbox()
+		fmt.Println()
+		printDuplicates()
+	case "dlq":
+		runDLQ(args[1:])
+	case "reconcile":
+		runReconcile(args[1:])
+	case "runs":
+		runRuns(args[1:])
+	case "matrix":
+		runMatrix(args[1:])
+	case "admin":
+		runAdmin(args[1:])
 	default:
 		fmt.Println("Unknown command:", command)
 		os.Exit(1)
@@ -75,29 +130,56 @@ func resetDB() {
 	fmt.Println("Database reset completed")
 }
 
-func runSimulator(count int) {
-	fmt.Printf("Starting simulation with %d iterations using 4 goroutines\n", count)
+func runSimulator(opts simulatorOptions) {
+	if err := applySeed(opts.Seed); err != nil {
+		slog.Warn("Failed to seed the services, the run cannot be repeated with its seed", "seed", opts.Seed, "error", err)
+	}
+
+	runID, outcome, lines, err := simulate(opts, snapshotConfig(appConfig, opts))
+	if err != nil {
+		slog.Error("Failed to run simulation", "error", err)
+		return
+	}
+
+	if outcome.Orders > 0 {
+		printReconciliation("Reconciliation for run "+runID, lines)
+		fmt.Println()
+		printSettlementSummary("Settlement Summary for run "+runID, outcome.Settlement)
+	}
+	fmt.Printf("\nRun %s recorded, see go run ./tooling runs show %s\n", runID, runID)
+}
+
+// simulate runs opts.Count iterations, waits for the orders to settle and
+// records the run under config. It returns the run's reconciliation lines so
+// the caller can print them.
+func simulate(opts simulatorOptions, config runConfig) (string, runOutcome, []reconcileLine, error) {
+	runID := utils.GenerateUUID7()
+	if err := startRun(runID, config); err != nil {
+		return "", runOutcome{}, nil, err
+	}
+
+	fmt.Printf("Starting simulation run %s with %d iterations using %d goroutines\n", runID, opts.Count, opts.Concurrency)
 
-	chunkSize := count / 4
-	if count%4 != 0 {
+	chunkSize := opts.Count / opts.Concurrency
+	if opts.Count%opts.Concurrency != 0 {
 		chunkSize++
 	}
 
 	var wg sync.WaitGroup
-	results := make(chan string, count)
+	results := make(chan string, opts.Count)
 
-	for i := 0; i < 4; i++ {
+	for i := 0; i < opts.Concurrency; i++ {
 		wg.Add(1)
 		start := i * chunkSize
 		end := start + chunkSize
-		if end > count {
-			end = count
+		if end > opts.Count {
+			end = opts.Count
 		}
 
 		go func(start, end int) {
 			defer wg.Done()
 			for j := start; j < end; j++ {
-				runSimulationIteration(j+1, results)
+				runSimulationIteration(runID, j+1, results)
 			}
 		}(start, end)
 	}
@@ -109,24 +191,54 @@ func runSimulator(count int) {
 
 	successCount := 0
 	timeoutCount := 0
+	finished := 0
 
 	for result := range results {
+		finished++
+		if len(opts.Switches) > 0 && finished == opts.SwitchAt {
+			fmt.Printf("Switching after %d iterations: %s\n", finished, switchFlag(opts.Switches))
+			if err := applySwitches(opts.Switches); err != nil {
+				slog.Error("Failed to switch settings mid-run", "error", err)
+			}
+			if err := recordAdminChange(runID, &config, finished); err != nil {
+				slog.Error("Failed to record mid-run admin config", "run_id", runID, "error", err)
+			}
+		}
 		if strings.Contains(result, "SUCCESS") {
 			successCount++
 		} else if strings.Contains(result, "TIMEOUT") {
 			timeoutCount++
 		}
-		fmt.Println(result)
+		if !opts.Quiet {
+			fmt.Println(result)
+		}
 	}
 
 	fmt.Printf("\nSimulation completed. Success: %d, Timeouts: %d\n", successCount, timeoutCount)
+
+	outcome := runOutcome{Succeeded: successCount, TimedOut: timeoutCount}
+	outcome.Orders, outcome.Settled = waitForSettlement(runID, opts.Wait)
+
+	var lines []reconcileLine
+	if outcome.Orders > 0 {
+		var err error
+		lines, err = measureRun(runID, &outcome)
+		if err != nil {
+			slog.Error("Failed to measure run outcome", "run_id", runID, "error", err)
+		}
+	}
+
+	if err := finishRun(runID, outcome); err != nil {
+		return runID, outcome, lines, fmt.Errorf("failed to store simulation run outcome: %w", err)
+	}
+	return runID, outcome, lines, nil
 }
 
-func runSimulationIteration(iteration int, results chan<- string) {
+func runSimulationIteration(runID string, iteration int, results chan<- string) {
 	correlationID := utils.GenerateCorrelationID()
 	logPrefix := "[" + correlationID + "] "
 
-	orderResp, err := createOrder()
+	orderResp, err := createOrder(runID)
 	if err != nil {
 		results <- fmt.Sprintf("Iteration %d [%s]: FAILED to create order - %v", iteration, correlationID, err)
 		return
@@ -164,12 +276,15 @@ func runSimulationIteration(iteration int, results chan<- string) {
 	}
 }
 
-func createOrder() (*models.CreateOrderResponse, error) {
+func createOrder(runID string) (*models.CreateOrderResponse, error) {
 	correlationID := utils.GenerateCorrelationID()
 	logPrefix := "[" + correlationID + "] "
 
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
 	client := httpclient.NewClient(500 * time.Millisecond)
-	resp, err := client.PostJSONWithTimeout("http://localhost:8000/create-order", nil, 500*time.Millisecond)
+	resp, err := client.PostJSONWithHeaders(ctx, appConfig.Order.URL+"/create-order", nil, map[string]string{models.HeaderRunID: runID})
 	if err != nil {
 		slog.Error(logPrefix+"Failed to create order", "error", err)
 		return nil, err
@@ -197,15 +312,10 @@ func triggerPayment(orderID string, amount int) error {
 
 	slog.Info(logPrefix+"Triggering payment", "order_id", orderID, "amount", amount)
 
-	timeoutMs := 200
-	if envTimeout := os.Getenv("PAYMENT_TIMEOUT_MS"); envTimeout != "" {
-		if t, err := strconv.Atoi(envTimeout); err == nil {
-			timeoutMs = t
-		}
-	}
+	timeout := appConfig.Payment.Timeout
 
-	client := httpclient.NewClient(time.Duration(timeoutMs) * time.Millisecond)
-	resp, err := client.PostJSONWithTimeout("http://localhost:8001/trigger-payment-paid", paymentReq, time.Duration(timeoutMs)*time.Millisecond)
+	client := httpclient.NewClient(timeout)
+	resp, err := client.PostJSONWithTimeout(appConfig.Payment.URL+"/trigger-payment-paid", paymentReq, timeout)
 	if err != nil {
 		if client.IsTimeoutError(err) {
 			slog.Error(logPrefix+"Payment timeout", "order_id", orderID)
@@ -326,14 +436,18 @@ func printInternalSettlement() {
 
 	var orders []models.Order
 	totalFulfilledAmount := 0
+	totalFailedAmount := 0
 	for rows.Next() {
 		var order models.Order
 		if err := rows.Scan(&order.ID, &order.Amount, &order.AdminFee, &order.Type, &order.Operator, &order.DestinationPhone, &order.Total, &order.Status, &order.CreatedAt); err != nil {
 			slog.Error("Failed to scan internal order", "error", err)
 			continue
 		}
-		if order.Status == "fulfilment" {
+		switch order.Status {
+		case orderstate.Completed:
 			totalFulfilledAmount += order.Total
+		case orderstate.Failed:
+			totalFailedAmount += order.Total
 		}
 		orders = append(orders, order)
 	}
@@ -358,6 +472,7 @@ func printInternalSettlement() {
 	table.PrintFooter()
 	fmt.Printf("Total internal orders: %d\n", len(orders))
 	fmt.Println("Total fulfilled amount: ", totalFulfilledAmount)
+	fmt.Println("Total failed amount: ", totalFailedAmount)
 }
 
 func printAttempt() {
@@ -371,6 +486,7 @@ func printAttempt() {
 				fa.id, 
 				fa.order_id, 
 				fa.payload, 
+				COALESCE(fa.outcome, ''),
 				fa.attempted_at,
 				ROW_NUMBER() OVER (PARTITION BY fa.order_id ORDER BY fa.attempted_at ASC) as attempt_number
 			  FROM fulfillment_attempts fa
@@ -388,7 +504,8 @@ func printAttempt() {
 	table.AddColumn("ID", 3, "left", nil)
 	table.AddColumn("Order ID", 38, "left", nil)
 	table.AddColumn("Attempt", 9, "right", nil)
-	table.AddColumn("Payload", 60, "left", nil)
+	table.AddColumn("Payload", 48, "left", nil)
+	table.AddColumn("Outcome", 10, "left", nil)
 	table.AddColumn("Attempted At", 21, "left", nil)
 
 	table.PrintHeader()
@@ -397,6 +514,7 @@ func printAttempt() {
 		ID            int
 		OrderID       string
 		Payload       string
+		Outcome       string
 		AttemptedAt   time.Time
 		AttemptNumber int
 	}
@@ -406,10 +524,11 @@ func printAttempt() {
 			ID            int
 			OrderID       string
 			Payload       string
+			Outcome       string
 			AttemptedAt   time.Time
 			AttemptNumber int
 		}
-		if err := rows.Scan(&attempt.ID, &attempt.OrderID, &attempt.Payload, &attempt.AttemptedAt, &attempt.AttemptNumber); err != nil {
+		if err := rows.Scan(&attempt.ID, &attempt.OrderID, &attempt.Payload, &attempt.Outcome, &attempt.AttemptedAt, &attempt.AttemptNumber); err != nil {
 			slog.Error("Failed to scan fulfillment attempt", "error", err)
 			continue
 		}
@@ -425,7 +544,8 @@ func printAttempt() {
 				attempt.ID,
 				truncateString(attempt.OrderID, 36),
 				attempt.AttemptNumber,
-				truncateString(attempt.Payload, 58),
+				truncateString(attempt.Payload, 46),
+				attempt.Outcome,
 				attemptedTime.Format("2006-01-02 15:04:05"),
 			})
 		}
@@ -435,6 +555,146 @@ func printAttempt() {
 	fmt.Printf("Total fulfillment attempts: %d\n", len(attempts))
 }
 
+func printInbox() {
+	today, startOfDay, endOfDay := getTodayDateRange()
+	jakartaLoc := getJakartaLocation()
+
+	slog.Info("Printing inbox audit", "date", today, "timezone", jakartaLoc.String())
+
+	query := `SELECT message_id, order_id, subject, deliveries, processed_at, last_delivered_at
+			  FROM inbox
+			  WHERE processed_at >= ? AND processed_at < ?
+			  ORDER BY processed_at ASC`
+
+	rows, err := database.DB.Query(query, startOfDay, endOfDay)
+	if err != nil {
+		slog.Error("Failed to query inbox", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	table := NewTable("Inbox Audit for " + today + " (" + jakartaLoc.String() + ")")
+	table.AddColumn("Message ID", 38, "left", nil)
+	table.AddColumn("Order ID", 38, "left", nil)
+	table.AddColumn("Subject", 14, "left", nil)
+	table.AddColumn("Deliveries", 12, "right", nil)
+	table.AddColumn("Processed At", 21, "left", nil)
+	table.AddColumn("Last Delivered At", 21, "left", nil)
+
+	table.PrintHeader()
+
+	var messages []struct {
+		MessageID       string
+		OrderID         string
+		Subject         string
+		Deliveries      int
+		ProcessedAt     time.Time
+		LastDeliveredAt time.Time
+	}
+
+	redeliveries := 0
+	for rows.Next() {
+		var message struct {
+			MessageID       string
+			OrderID         string
+			Subject         string
+			Deliveries      int
+			ProcessedAt     time.Time
+			LastDeliveredAt time.Time
+		}
+		if err := rows.Scan(&message.MessageID, &message.OrderID, &message.Subject, &message.Deliveries, &message.ProcessedAt, &message.LastDeliveredAt); err != nil {
+			slog.Error("Failed to scan inbox message", "error", err)
+			continue
+		}
+		redeliveries += message.Deliveries - 1
+		messages = append(messages, message)
+	}
+
+	if len(messages) == 0 {
+		table.PrintEmptyRow("No inbox messages today")
+	} else {
+		for _, message := range messages {
+			table.PrintRow([]interface{}{
+				truncateString(message.MessageID, 36),
+				truncateString(message.OrderID, 36),
+				truncateString(message.Subject, 12),
+				message.Deliveries,
+				message.ProcessedAt.In(jakartaLoc).Format("2006-01-02 15:04:05"),
+				message.LastDeliveredAt.In(jakartaLoc).Format("2006-01-02 15:04:05"),
+			})
+		}
+	}
+
+	table.PrintFooter()
+	fmt.Printf("Total inbox messages: %d\n", len(messages))
+	fmt.Printf("Total redeliveries: %d\n", redeliveries)
+}
+
+func printDuplicates() {
+	today, startOfDay, endOfDay := getTodayDateRange()
+	jakartaLoc := getJakartaLocation()
+
+	slog.Info("Printing duplicate attribution", "date", today, "timezone", jakartaLoc.String())
+
+	// Broker and vendor details carry a per-order id, so only the strategy
+	// name is worth grouping on.
+	query := `SELECT layer, IF(layer = 'strategy', detail, '') AS grouped_detail, COUNT(*), COUNT(DISTINCT order_id)
+			  FROM duplicate_events
+			  WHERE detected_at >= ? AND detected_at < ?
+			  GROUP BY layer, grouped_detail
+			  ORDER BY FIELD(layer, 'broker', 'inbox', 'strategy', 'vendor'), grouped_detail`
+
+	rows, err := database.DB.Query(query, startOfDay, endOfDay)
+	if err != nil {
+		slog.Error("Failed to query duplicate events", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	table := NewTable("Duplicates Caught by Layer for " + today + " (" + jakartaLoc.String() + ")")
+	table.AddColumn("Layer", 10, "left", nil)
+	table.AddColumn("Detail", 40, "left", nil)
+	table.AddColumn("Duplicates", 12, "right", nil)
+	table.AddColumn("Orders", 8, "right", nil)
+
+	table.PrintHeader()
+
+	type layerCount struct {
+		Layer      string
+		Detail     string
+		Duplicates int
+		Orders     int
+	}
+
+	var counts []layerCount
+	totalDuplicates := 0
+	for rows.Next() {
+		var count layerCount
+		if err := rows.Scan(&count.Layer, &count.Detail, &count.Duplicates, &count.Orders); err != nil {
+			slog.Error("Failed to scan duplicate events", "error", err)
+			continue
+		}
+		counts = append(counts, count)
+		totalDuplicates += count.Duplicates
+	}
+
+	if len(counts) == 0 {
+		table.PrintEmptyRow("No duplicates caught today")
+	} else {
+		for _, count := range counts {
+			table.PrintRow([]interface{}{
+				count.Layer,
+				truncateString(count.Detail, 38),
+				count.Duplicates,
+				count.Orders,
+			})
+		}
+	}
+
+	table.PrintFooter()
+	fmt.Printf("Total duplicates caught: %d\n", totalDuplicates)
+}
+
 func getJakartaLocation() *time.Location {
 	jakartaLoc, err := time.LoadLocation("Asia/Jakarta")
 	if err != nil {
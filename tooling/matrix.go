@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"substack-idempotency/pkg/database"
+	"substack-idempotency/pkg/httpclient"
+	"substack-idempotency/pkg/idempotency"
+	"substack-idempotency/pkg/orderstate"
+	"substack-idempotency/pkg/stack"
+)
+
+const serviceStartTimeout = 10 * time.Second
+
+type scenario struct {
+	Internal bool
+	External bool
+	Strategy string
+}
+
+type scenarioResult struct {
+	Scenario             scenario
+	RunID                string
+	Outcome              runOutcome
+	DuplicateFulfilments int
+	P50                  time.Duration
+	P95                  time.Duration
+	Err                  error
+}
+
+func runMatrix(args []string) {
+	flags := flag.NewFlagSet("matrix", flag.ExitOnError)
+	iterations := flags.Int("iterations", 50, "Orders to simulate per scenario")
+	strategies := flags.String("strategies", strings.Join(idempotency.Names(), ","), "Comma separated strategies to run with IDEMPOTENCY_CHECK=true")
+	concurrency := flags.Int("concurrency", 4, "Number of goroutines running iterations")
+	wait := flags.Duration("wait", 60*time.Second, "How long to wait for each scenario's orders to settle")
+	seed := flags.Int64("seed", time.Now().UnixNano(), "Seed for the services' random decisions in every scenario")
+	format := flags.String("format", "md", "Output format: md or csv")
+	output := flags.String("output", "", "File to write the table to (default: stdout)")
+	flags.Parse(args)
+
+	if *iterations < 1 || *concurrency < 1 {
+		fmt.Println("--iterations and --concurrency must be at least 1")
+		os.Exit(1)
+	}
+	if *format != "md" && *format != "csv" {
+		fmt.Println("Unknown format:", *format)
+		os.Exit(1)
+	}
+
+	var names []string
+	for _, name := range strings.Split(*strategies, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	opts := simulatorOptions{Count: *iterations, Concurrency: *concurrency, Seed: *seed, Wait: *wait, Quiet: true}
+
+	var results []scenarioResult
+	for _, sc := range matrixScenarios(names) {
+		fmt.Printf("\n=== internal=%t external=%t strategy=%s ===\n", sc.Internal, sc.External, scenarioStrategy(sc))
+		result := runScenario(sc, opts)
+		if result.Err != nil {
+			slog.Error("Scenario failed", "internal", sc.Internal, "external", sc.External, "strategy", sc.Strategy, "error", result.Err)
+		}
+		results = append(results, result)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			slog.Error("Failed to create output file", "error", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		out = file
+	} else {
+		fmt.Println()
+	}
+
+	if *format == "csv" {
+		writeMatrixCSV(out, results)
+	} else {
+		writeMatrixMarkdown(out, results)
+	}
+}
+
+// matrixScenarios lists the four combinations from the README. Strategies
+// only matter when the internal check is on, so those combinations are run
+// once per strategy.
+func matrixScenarios(strategies []string) []scenario {
+	var scenarios []scenario
+	for _, internal := range []bool{true, false} {
+		for _, external := range []bool{true, false} {
+			if !internal {
+				scenarios = append(scenarios, scenario{Internal: internal, External: external})
+				continue
+			}
+			for _, name := range strategies {
+				scenarios = append(scenarios, scenario{Internal: internal, External: external, Strategy: name})
+			}
+		}
+	}
+	return scenarios
+}
+
+func scenarioStrategy(sc scenario) string {
+	if !sc.Internal {
+		return "-"
+	}
+	return sc.Strategy
+}
+
+// runScenario starts the services in-process with the scenario's toggles,
+// runs the simulator against them and stops them again. Every scenario gets
+// a fresh NATS server and empty tables, so no messages carry over between
+// scenarios, and orders a previous scenario left unsettled are not retried
+// under this one's toggles.
+func runScenario(sc scenario, opts simulatorOptions) scenarioResult {
+	result := scenarioResult{Scenario: sc}
+
+	if err := database.ResetTables(); err != nil {
+		result.Err = fmt.Errorf("failed to reset tables before the scenario: %w", err)
+		return result
+	}
+
+	cfg := appConfig
+	cfg.Order.IdempotencyCheck = sc.Internal
+	cfg.Order.IdempotencyStrategy = sc.Strategy
+	cfg.Vendor.IdempotencyCheck = sc.External
+	cfg.Random.Seed = opts.Seed
+
+	services, err := stack.New(cfg)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- services.Run(ctx)
+	}()
+
+	if err := waitForServices(serviceStartTimeout); err != nil {
+		slog.Warn("Services not up before the run, its admin snapshot may be incomplete", "error", err)
+	}
+	result.RunID, result.Outcome, _, result.Err = simulate(opts, snapshotConfig(cfg, opts))
+
+	cancel()
+	if err := <-done; err != nil && result.Err == nil {
+		result.Err = err
+	}
+
+	if result.RunID != "" {
+		settlement := result.Outcome.Settlement
+		result.DuplicateFulfilments = settlement.Disbursements - settlement.FulfilledOrders
+		latencies, err := settleLatencies(result.RunID)
+		if err != nil {
+			slog.Error("Failed to load settle latencies", "run_id", result.RunID, "error", err)
+		}
+		result.P50, result.P95 = percentile(latencies, 50), percentile(latencies, 95)
+	}
+	return result
+}
+
+// waitForServices polls every service's /health until it answers, so the run
+// starts, and snapshots the admin config, once the in-process services are
+// listening.
+func waitForServices(timeout time.Duration) error {
+	client := httpclient.NewClient(time.Second)
+	deadline := time.Now().Add(timeout)
+	for _, service := range adminServices {
+		url, err := adminServiceURL(service)
+		if err != nil {
+			return err
+		}
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			resp, err := client.GetWithHeaders(ctx, url+"/health", nil)
+			cancel()
+			if err == nil {
+				resp.Body.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s did not come up within %s: %w", service, timeout, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// settleLatencies returns, for every order of the run that reached a final
+// status, the time from being marked paid to being completed or failed.
+func settleLatencies(runID string) ([]time.Duration, error) {
+	query := `SELECT MIN(CASE WHEN h.to_status = ? THEN h.changed_at END),
+				  MAX(CASE WHEN h.to_status IN (?, ?) THEN h.changed_at END)
+			  FROM order_status_history h
+			  JOIN internal_orders io ON io.id = h.order_id
+			  WHERE io.run_id = ?
+			  GROUP BY h.order_id`
+	rows, err := database.DB.Query(query, orderstate.Paid, orderstate.Completed, orderstate.Failed, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var latencies []time.Duration
+	for rows.Next() {
+		var paidAt, settledAt *time.Time
+		if err := rows.Scan(&paidAt, &settledAt); err != nil {
+			return nil, err
+		}
+		if paidAt != nil && settledAt != nil {
+			latencies = append(latencies, settledAt.Sub(*paidAt))
+		}
+	}
+	return latencies, rows.Err()
+}
+
+func percentile(latencies []time.Duration, p int) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+var matrixHeader = []string{"Internal", "External", "Strategy", "Orders", "Settled", "Duplicate fulfilments", "Over-disbursed", "Money at risk", "p50 paid→settled", "p95 paid→settled", "Run ID"}
+
+func matrixRow(result scenarioResult) []string {
+	sc := result.Scenario
+	if result.RunID == "" {
+		return []string{strconv.FormatBool(sc.Internal), strconv.FormatBool(sc.External), scenarioStrategy(sc), "-", "-", "-", "-", "-", "-", "-", "error: " + result.Err.Error()}
+	}
+
+	outcome := result.Outcome
+	return []string{
+		strconv.FormatBool(sc.Internal),
+		strconv.FormatBool(sc.External),
+		scenarioStrategy(sc),
+		strconv.Itoa(outcome.Orders),
+		strconv.Itoa(outcome.Settled),
+		strconv.Itoa(result.DuplicateFulfilments),
+		strconv.Itoa(outcome.Settlement.DuplicateCost()),
+		strconv.Itoa(outcome.MoneyAtRisk),
+		result.P50.Round(time.Millisecond).String(),
+		result.P95.Round(time.Millisecond).String(),
+		result.RunID,
+	}
+}
+
+func writeMatrixMarkdown(w io.Writer, results []scenarioResult) {
+	fmt.Fprintln(w, "| "+strings.Join(matrixHeader, " | ")+" |")
+	fmt.Fprintln(w, "|"+strings.Repeat("---|", len(matrixHeader)))
+	for _, result := range results {
+		fmt.Fprintln(w, "| "+strings.Join(matrixRow(result), " | ")+" |")
+	}
+}
+
+func writeMatrixCSV(w io.Writer, results []scenarioResult) {
+	writer := csv.NewWriter(w)
+	writer.Write(matrixHeader)
+	for _, result := range results {
+		writer.Write(matrixRow(result))
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		slog.Error("Failed to write CSV", "error", err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"substack-idempotency/pkg/database"
+	"substack-idempotency/pkg/orderstate"
+)
+
+const (
+	categoryMatched        = "matched"
+	categoryFulfilledTwice = "fulfilled more than once"
+	categoryAmountMismatch = "amount mismatch"
+	categoryNotCompleted   = "vendor success, not completed"
+	categoryNeverFulfilled = "paid, never fulfilled"
+	categoryRefundDue      = "paid, failed, refund due"
+)
+
+const reconcileDetailRowsLimit = 50
+
+var reconcileCategories = []string{
+	categoryMatched,
+	categoryFulfilledTwice,
+	categoryAmountMismatch,
+	categoryNotCompleted,
+	categoryNeverFulfilled,
+	categoryRefundDue,
+}
+
+type reconcileLine struct {
+	OrderID         string
+	Status          string
+	Amount          int
+	Total           int
+	VendorRows      int
+	VendorSuccesses int
+	AmountMismatch  int
+	Paid            bool
+	Category        string
+	AtRisk          int
+}
+
+func runReconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	date := flags.String("date", "", "Day to reconcile as YYYY-MM-DD (default: today)")
+	flags.Parse(args)
+
+	checkDatabaseTimezone()
+	day, startOfDay, endOfDay := getTodayDateRange()
+	if *date != "" {
+		start, err := time.ParseInLocation("2006-01-02", *date, getJakartaLocation())
+		if err != nil {
+			fmt.Println("Invalid date:", *date)
+			os.Exit(1)
+		}
+		day, startOfDay, endOfDay = *date, start, start.Add(24*time.Hour)
+	}
+
+	lines, err := reconcile("io.created_at >= ? AND io.created_at < ?", startOfDay, endOfDay)
+	if err != nil {
+		slog.Error("Failed to reconcile orders", "error", err)
+		os.Exit(1)
+	}
+
+	if discrepancies := printReconciliation("Reconciliation for "+day+" ("+getJakartaLocation().String()+")", lines); discrepancies > 0 {
+		os.Exit(1)
+	}
+}
+
+// reconcile matches internal orders selected by filter, a condition on the
+// io alias, against every ext_orders row for the same order-id, and notes
+// whether internal_payments holds a payment for the order.
+func reconcile(filter string, args ...interface{}) ([]reconcileLine, error) {
+	query := `SELECT io.id, io.status, io.amount, io.total,
+				COUNT(eo.id),
+				COALESCE(SUM(eo.status = 'success'), 0),
+				COALESCE(SUM(CASE WHEN eo.status = 'success' THEN ABS(eo.amount - io.amount) ELSE 0 END), 0),
+				EXISTS (SELECT 1 FROM internal_payments ip WHERE ip.order_id = io.id)
+			  FROM internal_orders io
+			  LEFT JOIN ext_orders eo ON eo.order_id = io.id
+			  WHERE ` + filter + `
+			  GROUP BY io.id, io.status, io.amount, io.total, io.created_at
+			  ORDER BY io.created_at ASC`
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query orders: %w", err)
+	}
+	defer rows.Close()
+
+	var lines []reconcileLine
+	for rows.Next() {
+		var line reconcileLine
+		if err := rows.Scan(&line.OrderID, &line.Status, &line.Amount, &line.Total, &line.VendorRows, &line.VendorSuccesses, &line.AmountMismatch, &line.Paid); err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		line.Category, line.AtRisk = categorize(line)
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// categorize puts an order in the first category that applies. Money at risk
+// is what the vendor disbursed on top of the order, or what the customer paid
+// for nothing. A failed order the customer paid for is owed a refund until it
+// moves to refunded.
+func categorize(line reconcileLine) (string, int) {
+	switch {
+	case line.VendorSuccesses > 1:
+		return categoryFulfilledTwice, (line.VendorSuccesses - 1) * line.Amount
+	case line.AmountMismatch > 0:
+		return categoryAmountMismatch, line.AmountMismatch
+	case line.VendorSuccesses == 1 && line.Status != orderstate.Completed:
+		return categoryNotCompleted, line.Amount
+	case line.VendorSuccesses == 0 && paidStatus(line.Status):
+		return categoryNeverFulfilled, line.Total
+	case line.VendorSuccesses == 0 && line.Status == orderstate.Failed && line.Paid:
+		return categoryRefundDue, line.Total
+	default:
+		return categoryMatched, 0
+	}
+}
+
+// paidStatus reports whether the customer has paid for an order that has not
+// been settled as failed or given back.
+func paidStatus(status string) bool {
+	switch status {
+	case orderstate.Paid, orderstate.Fulfilment, orderstate.Unknown, orderstate.Completed:
+		return true
+	default:
+		return false
+	}
+}
+
+// printReconciliation prints the per-category summary and the discrepancies,
+// and returns how many orders are not matched.
+func printReconciliation(title string, lines []reconcileLine) int {
+	type categoryTotal struct {
+		Orders int
+		AtRisk int
+	}
+
+	totals := make(map[string]*categoryTotal)
+	for _, category := range reconcileCategories {
+		totals[category] = &categoryTotal{}
+	}
+
+	var discrepancies []reconcileLine
+	totalAtRisk := 0
+	for _, line := range lines {
+		totals[line.Category].Orders++
+		totals[line.Category].AtRisk += line.AtRisk
+		totalAtRisk += line.AtRisk
+		if line.Category != categoryMatched {
+			discrepancies = append(discrepancies, line)
+		}
+	}
+
+	table := NewTable(title)
+	table.AddColumn("Category", 32, "left", nil)
+	table.AddColumn("Orders", 8, "right", nil)
+	table.AddColumn("Money at Risk", 15, "right", nil)
+
+	table.PrintHeader()
+	for _, category := range reconcileCategories {
+		table.PrintRow([]interface{}{category, totals[category].Orders, totals[category].AtRisk})
+	}
+	table.PrintFooter()
+
+	if len(discrepancies) > 0 {
+		fmt.Println()
+		detail := NewTable("Discrepancies")
+		detail.AddColumn("Order ID", 38, "left", nil)
+		detail.AddColumn("Category", 32, "left", nil)
+		detail.AddColumn("Status", 12, "left", nil)
+		detail.AddColumn("Vendor Rows", 13, "right", nil)
+		detail.AddColumn("Successes", 11, "right", nil)
+		detail.AddColumn("At Risk", 9, "right", nil)
+
+		detail.PrintHeader()
+		for i, line := range discrepancies {
+			if i == reconcileDetailRowsLimit {
+				detail.PrintEmptyRow(fmt.Sprintf("... %d more", len(discrepancies)-i))
+				break
+			}
+			detail.PrintRow([]interface{}{
+				truncateString(line.OrderID, 36),
+				line.Category,
+				line.Status,
+				line.VendorRows,
+				line.VendorSuccesses,
+				line.AtRisk,
+			})
+		}
+		detail.PrintFooter()
+	}
+
+	fmt.Printf("Total orders: %d\n", len(lines))
+	fmt.Printf("Discrepancies: %d\n", len(discrepancies))
+	fmt.Println("Total money at risk: ", totalAtRisk)
+	return len(discrepancies)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"substack-idempotency/pkg/config"
+	"substack-idempotency/pkg/database"
+)
+
+type runConfig struct {
+	IdempotencyCheck         string          `json:"idempotency_check"`
+	IdempotencyStrategy      string          `json:"idempotency_strategy"`
+	ExternalIdempotencyCheck string          `json:"external_idempotency_check"`
+	PublishDedupe            string          `json:"publish_dedupe"`
+	PaymentTimeoutMs         int             `json:"payment_timeout_ms"`
+	Seed                     int64           `json:"seed"`
+	Count                    int             `json:"count"`
+	Concurrency              int             `json:"concurrency"`
+	Faults                   string          `json:"faults,omitempty"`
+	SwitchAt                 int             `json:"switch_at,omitempty"`
+	Switches                 []string        `json:"switches,omitempty"`
+	Admin                    []adminSnapshot `json:"admin,omitempty"`
+}
+
+// adminSnapshot holds every service's GET /admin/config at one point of a
+// run. A service that could not be read, because it is not running or its
+// admin API is disabled, is listed in Errors instead.
+type adminSnapshot struct {
+	AfterIterations int                               `json:"after_iterations"`
+	Services        map[string]map[string]interface{} `json:"services"`
+	Errors          map[string]string                 `json:"errors,omitempty"`
+}
+
+var adminServices = []string{"order", "payment", "vendor", "proxy"}
+
+func snapshotAdmin(afterIterations int) adminSnapshot {
+	snapshot := adminSnapshot{
+		AfterIterations: afterIterations,
+		Services:        make(map[string]map[string]interface{}),
+	}
+	for _, service := range adminServices {
+		settings, err := getAdminConfig(service)
+		if err != nil {
+			if snapshot.Errors == nil {
+				snapshot.Errors = make(map[string]string)
+			}
+			snapshot.Errors[service] = err.Error()
+			continue
+		}
+		snapshot.Services[service] = settings
+	}
+	return snapshot
+}
+
+func (s adminSnapshot) value(service string, setting string) interface{} {
+	return s.Services[service][setting]
+}
+
+type runOutcome struct {
+	Orders        int              `json:"orders"`
+	Succeeded     int              `json:"succeeded"`
+	TimedOut      int              `json:"timed_out"`
+	Settled       int              `json:"settled"`
+	Discrepancies int              `json:"discrepancies"`
+	MoneyAtRisk   int              `json:"money_at_risk"`
+	Categories    map[string]int   `json:"categories"`
+	Settlement    settlementTotals `json:"settlement"`
+}
+
+type simulationRun struct {
+	ID         string
+	StartedAt  time.Time
+	FinishedAt sql.NullTime
+	Config     runConfig
+	Outcome    *runOutcome
+}
+
+// snapshotConfig records the settings the run was started with: every
+// service's admin config as it is running, and the toggles read from it. A
+// toggle whose service could not be read is taken from the tooling's own
+// configuration, which shares .env with the services.
+func snapshotConfig(cfg config.Config, opts simulatorOptions) runConfig {
+	var switches []string
+	for _, c := range opts.Switches {
+		switches = append(switches, c.String())
+	}
+	snapshot := snapshotAdmin(0)
+	for service, err := range snapshot.Errors {
+		slog.Warn("Failed to snapshot admin config, using the tooling's config", "service", service, "error", err)
+	}
+
+	run := runConfig{
+		IdempotencyCheck:         strconv.FormatBool(cfg.Order.IdempotencyCheck),
+		IdempotencyStrategy:      cfg.Order.IdempotencyStrategy,
+		ExternalIdempotencyCheck: strconv.FormatBool(cfg.Vendor.IdempotencyCheck),
+		PublishDedupe:            strconv.FormatBool(cfg.Payment.PublishDedupe),
+		PaymentTimeoutMs:         int(cfg.Payment.Timeout.Milliseconds()),
+		Seed:                     opts.Seed,
+		Count:                    opts.Count,
+		Concurrency:              opts.Concurrency,
+		Faults:                   armedFaults(cfg, snapshot),
+		SwitchAt:                 opts.SwitchAt,
+		Switches:                 switches,
+		Admin:                    []adminSnapshot{snapshot},
+	}
+	if v, ok := snapshot.value("order", "idempotency_check").(bool); ok {
+		run.IdempotencyCheck = strconv.FormatBool(v)
+	}
+	if v, ok := snapshot.value("order", "idempotency_strategy").(string); ok {
+		run.IdempotencyStrategy = v
+	}
+	if v, ok := snapshot.value("vendor", "idempotency_check").(bool); ok {
+		run.ExternalIdempotencyCheck = strconv.FormatBool(v)
+	}
+	if v, ok := snapshot.value("payment", "publish_dedupe").(bool); ok {
+		run.PublishDedupe = strconv.FormatBool(v)
+	}
+	if v, ok := snapshot.value("payment", "payment_timeout_ms").(float64); ok {
+		run.PaymentTimeoutMs = int(v)
+	}
+	return run
+}
+
+func startRun(runID string, config runConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run config: %w", err)
+	}
+
+	query := `INSERT INTO simulation_runs (id, started_at, config) VALUES (?, ?, ?)`
+	if _, err := database.DB.Exec(query, runID, time.Now(), data); err != nil {
+		return fmt.Errorf("failed to insert simulation run: %w", err)
+	}
+	return nil
+}
+
+// recordAdminChange snapshots the services' admin config again after the
+// simulator changed it mid-run, and stores it with the run's config.
+func recordAdminChange(runID string, config *runConfig, afterIterations int) error {
+	snapshot := snapshotAdmin(afterIterations)
+	for service, err := range snapshot.Errors {
+		slog.Warn("Failed to snapshot admin config", "service", service, "error", err)
+	}
+	config.Admin = append(config.Admin, snapshot)
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run config: %w", err)
+	}
+
+	query := `UPDATE simulation_runs SET config = ? WHERE id = ?`
+	if _, err := database.DB.Exec(query, data, runID); err != nil {
+		return fmt.Errorf("failed to update simulation run config: %w", err)
+	}
+	return nil
+}
+
+func finishRun(runID string, outcome runOutcome) error {
+	data, err := json.Marshal(outcome)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run outcome: %w", err)
+	}
+
+	query := `UPDATE simulation_runs SET finished_at = ?, outcome = ? WHERE id = ?`
+	if _, err := database.DB.Exec(query, time.Now(), data, runID); err != nil {
+		return fmt.Errorf("failed to update simulation run: %w", err)
+	}
+	return nil
+}
+
+func runRuns(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: go run ./tooling runs <list|show <id>|compare <id> <id>>")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		printRuns()
+	case "show":
+		if len(args) < 2 {
+			fmt.Println("Usage: go run ./tooling runs show <id>")
+			os.Exit(1)
+		}
+		showRun(args[1])
+	case "compare":
+		if len(args) < 3 {
+			fmt.Println("Usage: go run ./tooling runs compare <id> <id>")
+			os.Exit(1)
+		}
+		compareRuns(args[1], args[2])
+	default:
+		fmt.Println("Unknown runs command:", args[0])
+		os.Exit(1)
+	}
+}
+
+func scanRun(scanner interface{ Scan(...interface{}) error }) (simulationRun, error) {
+	var run simulationRun
+	var config []byte
+	var outcome []byte
+	if err := scanner.Scan(&run.ID, &run.StartedAt, &run.FinishedAt, &config, &outcome); err != nil {
+		return run, err
+	}
+	if err := json.Unmarshal(config, &run.Config); err != nil {
+		return run, fmt.Errorf("invalid config for run %s: %w", run.ID, err)
+	}
+	if outcome != nil {
+		run.Outcome = &runOutcome{}
+		if err := json.Unmarshal(outcome, run.Outcome); err != nil {
+			return run, fmt.Errorf("invalid outcome for run %s: %w", run.ID, err)
+		}
+	}
+	return run, nil
+}
+
+func getRun(runID string) (simulationRun, error) {
+	query := `SELECT id, started_at, finished_at, config, outcome FROM simulation_runs WHERE id = ?`
+	return scanRun(database.DB.QueryRow(query, runID))
+}
+
+func printRuns() {
+	jakartaLoc := getJakartaLocation()
+
+	query := `SELECT id, started_at, finished_at, config, outcome FROM simulation_runs ORDER BY started_at DESC LIMIT 50`
+	rows, err := database.DB.Query(query)
+	if err != nil {
+		slog.Error("Failed to list simulation runs", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	table := NewTable("Simulation Runs (latest 50)")
+	table.AddColumn("Run ID", 38, "left", nil)
+	table.AddColumn("Started At", 21, "left", nil)
+	table.AddColumn("Count", 7, "right", nil)
+	table.AddColumn("Internal", 10, "left", nil)
+	table.AddColumn("External", 10, "left", nil)
+	table.AddColumn("Strategy", 20, "left", nil)
+	table.AddColumn("Discrepancies", 15, "right", nil)
+	table.AddColumn("At Risk", 10, "right", nil)
+
+	table.PrintHeader()
+
+	var runs []simulationRun
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			slog.Error("Failed to scan simulation run", "error", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	if len(runs) == 0 {
+		table.PrintEmptyRow("No simulation runs recorded")
+	} else {
+		for _, run := range runs {
+			discrepancies, atRisk := "-", "-"
+			if run.Outcome != nil {
+				discrepancies = strconv.Itoa(run.Outcome.Discrepancies)
+				atRisk = strconv.Itoa(run.Outcome.MoneyAtRisk)
+			}
+			table.PrintRow([]interface{}{
+				run.ID,
+				run.StartedAt.In(jakartaLoc).Format("2006-01-02 15:04:05"),
+				run.Config.Count,
+				run.Config.IdempotencyCheck,
+				run.Config.ExternalIdempotencyCheck,
+				truncateString(run.Config.IdempotencyStrategy, 18),
+				discrepancies,
+				atRisk,
+			})
+		}
+	}
+
+	table.PrintFooter()
+	fmt.Printf("Total runs: %d\n", len(runs))
+}
+
+func showRun(runID string) {
+	run, err := getRun(runID)
+	if err == sql.ErrNoRows {
+		fmt.Println("Simulation run not found:", runID)
+		os.Exit(1)
+	}
+	if err != nil {
+		slog.Error("Failed to get simulation run", "error", err)
+		os.Exit(1)
+	}
+
+	table := NewTable("Simulation Run " + run.ID)
+	table.AddColumn("Field", 34, "left", nil)
+	table.AddColumn("Value", 40, "left", nil)
+
+	table.PrintHeader()
+	for _, row := range runRows(run) {
+		table.PrintRow([]interface{}{row[0], row[1]})
+	}
+	table.PrintFooter()
+	printAdminSnapshots(run.Config.Admin)
+
+	lines, err := reconcile("io.run_id = ?", run.ID)
+	if err != nil {
+		slog.Error("Failed to reconcile run", "error", err)
+		return
+	}
+	if len(lines) > 0 {
+		fmt.Println()
+		printReconciliation("Current reconciliation for run "+run.ID, lines)
+	}
+}
+
+func compareRuns(firstID string, secondID string) {
+	first, err := getRun(firstID)
+	if err != nil {
+		slog.Error("Failed to get simulation run", "run_id", firstID, "error", err)
+		os.Exit(1)
+	}
+	second, err := getRun(secondID)
+	if err != nil {
+		slog.Error("Failed to get simulation run", "run_id", secondID, "error", err)
+		os.Exit(1)
+	}
+
+	table := NewTable("Simulation Run Comparison")
+	table.AddColumn("Field", 34, "left", nil)
+	table.AddColumn(truncateString(first.ID, 36), 38, "left", nil)
+	table.AddColumn(truncateString(second.ID, 36), 38, "left", nil)
+
+	table.PrintHeader()
+	firstRows, secondRows := runRows(first), runRows(second)
+	for i := range firstRows {
+		table.PrintRow([]interface{}{firstRows[i][0], firstRows[i][1], secondRows[i][1]})
+	}
+	table.PrintFooter()
+}
+
+// runRows flattens a run into field/value pairs. Every run yields the same
+// fields in the same order so two runs can be printed side by side.
+func runRows(run simulationRun) [][2]string {
+	jakartaLoc := getJakartaLocation()
+
+	finishedAt, duration := "-", "-"
+	if run.FinishedAt.Valid {
+		finishedAt = run.FinishedAt.Time.In(jakartaLoc).Format("2006-01-02 15:04:05")
+		duration = run.FinishedAt.Time.Sub(run.StartedAt).Round(time.Millisecond).String()
+	}
+
+	rows := [][2]string{
+		{"Started at", run.StartedAt.In(jakartaLoc).Format("2006-01-02 15:04:05")},
+		{"Finished at", finishedAt},
+		{"Duration", duration},
+		{"IDEMPOTENCY_CHECK", run.Config.IdempotencyCheck},
+		{"IDEMPOTENCY_STRATEGY", run.Config.IdempotencyStrategy},
+		{"EXTERNAL_IDEMPOTENCY_CHECK", run.Config.ExternalIdempotencyCheck},
+		{"PUBLISH_DEDUPE", run.Config.PublishDedupe},
+		{"PAYMENT_TIMEOUT_MS", strconv.Itoa(run.Config.PaymentTimeoutMs)},
+		{"Seed", strconv.FormatInt(run.Config.Seed, 10)},
+		{"Count", strconv.Itoa(run.Config.Count)},
+		{"Concurrency", strconv.Itoa(run.Config.Concurrency)},
+		{"Faults", valueOrDash(run.Config.Faults)},
+		{"Mid-run switch", midRunSwitch(run.Config)},
+	}
+
+	outcome := run.Outcome
+	if outcome == nil {
+		outcome = &runOutcome{}
+	}
+	rows = append(rows,
+		[2]string{"Orders created", strconv.Itoa(outcome.Orders)},
+		[2]string{"Payments succeeded", strconv.Itoa(outcome.Succeeded)},
+		[2]string{"Payments timed out", strconv.Itoa(outcome.TimedOut)},
+		[2]string{"Orders settled", strconv.Itoa(outcome.Settled)},
+	)
+	for _, category := range reconcileCategories {
+		rows = append(rows, [2]string{"Orders " + category, strconv.Itoa(outcome.Categories[category])})
+	}
+	rows = append(rows,
+		[2]string{"Discrepancies", strconv.Itoa(outcome.Discrepancies)},
+		[2]string{"Money at risk", strconv.Itoa(outcome.MoneyAtRisk)},
+		[2]string{"Revenue collected", strconv.Itoa(outcome.Settlement.Collected)},
+		[2]string{"Disbursed to vendor", strconv.Itoa(outcome.Settlement.Disbursed)},
+		[2]string{"Duplicate disbursement cost", strconv.Itoa(outcome.Settlement.DuplicateCost())},
+	)
+	return rows
+}
+
+// printAdminSnapshots prints each service's admin config at the start of the
+// run and after every change the simulator made.
+func printAdminSnapshots(snapshots []adminSnapshot) {
+	for _, snapshot := range snapshots {
+		fmt.Println()
+		if snapshot.AfterIterations == 0 {
+			fmt.Println("Admin config at start:")
+		} else {
+			fmt.Printf("Admin config after %d iterations:\n", snapshot.AfterIterations)
+		}
+		for _, service := range adminServices {
+			if settings, ok := snapshot.Services[service]; ok {
+				data, _ := json.Marshal(settings)
+				fmt.Printf("  %-8s %s\n", service, data)
+			} else if err, ok := snapshot.Errors[service]; ok {
+				fmt.Printf("  %-8s unavailable: %s\n", service, err)
+			}
+		}
+	}
+}
+
+// armedFaults joins the faults armed in every service, as running when the
+// snapshot could read them and as configured at startup otherwise.
+func armedFaults(cfg config.Config, snapshot adminSnapshot) string {
+	configured := map[string]string{"order": cfg.Order.Faults, "payment": cfg.Payment.Faults, "vendor": cfg.Vendor.Faults}
+	var specs []string
+	for _, service := range []string{"order", "payment", "vendor"} {
+		spec, ok := snapshot.value(service, "faults").(string)
+		if !ok {
+			spec = configured[service]
+		}
+		if spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func midRunSwitch(config runConfig) string {
+	if len(config.Switches) == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("after %d: %s", config.SwitchAt, strings.Join(config.Switches, ", "))
+}
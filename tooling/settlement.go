@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"substack-idempotency/pkg/database"
+	"substack-idempotency/pkg/models"
+)
+
+func printFullSettlement() {
+	printInternalSettlement()
+	fmt.Println()
+	printExternalSettlement()
+	fmt.Println()
+	printPayments()
+	fmt.Println()
+
+	today, startOfDay, endOfDay := getTodayDateRange()
+	totals, err := loadSettlementTotals("paid_at >= ? AND paid_at < ?", "processed_at >= ? AND processed_at < ?", startOfDay, endOfDay)
+	if err != nil {
+		slog.Error("Failed to compute settlement summary", "error", err)
+		return
+	}
+	printSettlementSummary("Settlement Summary for "+today+" ("+getJakartaLocation().String()+")", totals)
+}
+
+func printPayments() {
+	today, startOfDay, endOfDay := getTodayDateRange()
+	jakartaLoc := getJakartaLocation()
+
+	query := `SELECT id, order_id, paid_amount, paid_at
+			  FROM internal_payments
+			  WHERE paid_at >= ? AND paid_at < ?
+			  ORDER BY paid_at ASC`
+
+	rows, err := database.DB.Query(query, startOfDay, endOfDay)
+	if err != nil {
+		slog.Error("Failed to query payments", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	table := NewTable("Payments for " + today + " (" + jakartaLoc.String() + ")")
+	table.AddColumn("ID", 5, "left", nil)
+	table.AddColumn("Order ID", 38, "left", nil)
+	table.AddColumn("Paid Amount", 13, "right", nil)
+	table.AddColumn("Paid At", 21, "left", nil)
+
+	table.PrintHeader()
+
+	var payments []models.InternalPayment
+	totalPaidAmount := 0
+	for rows.Next() {
+		var payment models.InternalPayment
+		if err := rows.Scan(&payment.ID, &payment.OrderID, &payment.PaidAmount, &payment.PaidAt); err != nil {
+			slog.Error("Failed to scan payment", "error", err)
+			continue
+		}
+		totalPaidAmount += payment.PaidAmount
+		payments = append(payments, payment)
+	}
+
+	if len(payments) == 0 {
+		table.PrintEmptyRow("No payments received today")
+	} else {
+		for _, payment := range payments {
+			table.PrintRow([]interface{}{
+				payment.ID,
+				truncateString(payment.OrderID, 36),
+				payment.PaidAmount,
+				payment.PaidAt.In(jakartaLoc).Format("2006-01-02 15:04:05"),
+			})
+		}
+	}
+
+	table.PrintFooter()
+	fmt.Printf("Total payments: %d\n", len(payments))
+	fmt.Println("Total paid amount: ", totalPaidAmount)
+}
+
+type settlementTotals struct {
+	Payments        int `json:"payments"`
+	Collected       int `json:"collected"`
+	Disbursements   int `json:"disbursements"`
+	Disbursed       int `json:"disbursed"`
+	FulfilledOrders int `json:"fulfilled_orders"`
+	Expected        int `json:"expected"`
+	Unfulfilled     int `json:"unfulfilled"`
+}
+
+func (t settlementTotals) DuplicateCost() int {
+	return t.Disbursed - t.Expected
+}
+
+// loadSettlementTotals sets the money collected from customers against the
+// money the vendor disbursed. Every successful vendor row beyond the first
+// for an order is a duplicate disbursement. paymentFilter and extFilter select
+// internal_payments and ext_orders rows and take the same args.
+func loadSettlementTotals(paymentFilter string, extFilter string, args ...interface{}) (settlementTotals, error) {
+	var totals settlementTotals
+
+	query := `SELECT COUNT(*), COALESCE(SUM(paid_amount), 0) FROM internal_payments WHERE ` + paymentFilter
+	if err := database.DB.QueryRow(query, args...).Scan(&totals.Payments, &totals.Collected); err != nil {
+		return totals, fmt.Errorf("failed to sum payments: %w", err)
+	}
+
+	query = `SELECT COUNT(*), COALESCE(SUM(amount), 0), COUNT(DISTINCT order_id)
+			 FROM ext_orders
+			 WHERE status = 'success' AND ` + extFilter
+	if err := database.DB.QueryRow(query, args...).Scan(&totals.Disbursements, &totals.Disbursed, &totals.FulfilledOrders); err != nil {
+		return totals, fmt.Errorf("failed to sum vendor disbursements: %w", err)
+	}
+
+	query = `SELECT COALESCE(SUM(amount), 0) FROM (
+				SELECT MIN(amount) AS amount
+				FROM ext_orders
+				WHERE status = 'success' AND ` + extFilter + `
+				GROUP BY order_id
+			 ) first_disbursements`
+	if err := database.DB.QueryRow(query, args...).Scan(&totals.Expected); err != nil {
+		return totals, fmt.Errorf("failed to sum expected disbursements: %w", err)
+	}
+
+	query = `SELECT COALESCE(SUM(paid_amount), 0)
+			 FROM internal_payments
+			 WHERE ` + paymentFilter + `
+			   AND NOT EXISTS (SELECT 1 FROM ext_orders eo WHERE eo.order_id = internal_payments.order_id AND eo.status = 'success')`
+	if err := database.DB.QueryRow(query, args...).Scan(&totals.Unfulfilled); err != nil {
+		return totals, fmt.Errorf("failed to sum unfulfilled payments: %w", err)
+	}
+
+	return totals, nil
+}
+
+func printSettlementSummary(title string, totals settlementTotals) {
+	table := NewTable(title)
+	table.AddColumn("Item", 44, "left", nil)
+	table.AddColumn("Count", 8, "right", nil)
+	table.AddColumn("Amount", 14, "right", nil)
+
+	table.PrintHeader()
+	table.PrintRow([]interface{}{"Revenue collected (payments)", totals.Payments, totals.Collected})
+	table.PrintRow([]interface{}{"Disbursed to vendor (success rows)", totals.Disbursements, totals.Disbursed})
+	table.PrintRow([]interface{}{"Expected disbursement (one per order)", totals.FulfilledOrders, totals.Expected})
+	table.PrintRow([]interface{}{"Duplicate disbursement cost", totals.Disbursements - totals.FulfilledOrders, totals.DuplicateCost()})
+	table.PrintRow([]interface{}{"Paid but never disbursed", "", totals.Unfulfilled})
+	table.PrintRow([]interface{}{"Net (collected - disbursed)", "", totals.Collected - totals.Disbursed})
+	table.PrintFooter()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"substack-idempotency/pkg/database"
+	"substack-idempotency/pkg/orderstate"
+)
+
+const settlementPollInterval = 500 * time.Millisecond
+
+type simulatorOptions struct {
+	Count       int
+	Concurrency int
+	Seed        int64
+	Wait        time.Duration
+	Quiet       bool
+	// Switches are applied through the admin API once SwitchAt iterations
+	// have finished, so the run covers the change as it happens.
+	SwitchAt int
+	Switches []configSwitch
+}
+
+// waitForSettlement polls until no order of the run has a retry due and the
+// vendor rows for the run stopped changing, so late duplicates and
+// redeliveries are counted too. An order has no retry due once it was paid and
+// either has nothing scheduled or has used up its retries, which also covers
+// orders left failed or unknown for manual follow-up. It gives up after wait
+// and returns how many orders the run created and how many settled.
+func waitForSettlement(runID string, wait time.Duration) (int, int) {
+	var orders int
+	if err := database.DB.QueryRow(`SELECT COUNT(*) FROM internal_orders WHERE run_id = ?`, runID).Scan(&orders); err != nil {
+		slog.Error("Failed to count run orders", "error", err)
+		return 0, 0
+	}
+	if orders == 0 {
+		return 0, 0
+	}
+
+	fmt.Printf("\nWaiting up to %s for %d orders to settle\n", wait, orders)
+
+	settledQuery := `SELECT COUNT(*) FROM internal_orders
+					 WHERE run_id = ? AND status <> ? AND (next_retry_at IS NULL OR retry_count >= ?)`
+	vendorQuery := `SELECT COUNT(*) FROM ext_orders WHERE order_id IN (SELECT id FROM internal_orders WHERE run_id = ?)`
+
+	maxRetries := orderMaxRetries()
+	deadline := time.Now().Add(wait)
+	lastVendorRows := -1
+	settled := 0
+	for {
+		var vendorRows int
+		if err := database.DB.QueryRow(settledQuery, runID, orderstate.Pending, maxRetries).Scan(&settled); err != nil {
+			slog.Error("Failed to count settled orders", "error", err)
+		}
+		if err := database.DB.QueryRow(vendorQuery, runID).Scan(&vendorRows); err != nil {
+			slog.Error("Failed to count vendor rows", "error", err)
+		}
+
+		if settled == orders && vendorRows == lastVendorRows {
+			fmt.Printf("All %d orders settled\n\n", settled)
+			return orders, settled
+		}
+		lastVendorRows = vendorRows
+
+		if time.Now().After(deadline) {
+			fmt.Printf("Deadline reached with %d of %d orders settled\n\n", settled, orders)
+			return orders, settled
+		}
+		time.Sleep(settlementPollInterval)
+	}
+}
+
+// orderMaxRetries reads the retry limit internal-order is running with, which
+// the admin API may have changed, and falls back to the tooling's own config.
+func orderMaxRetries() int {
+	settings, err := getAdminConfig("order")
+	if err != nil {
+		slog.Warn("Failed to read internal-order max_retries, using FULFILMENT_MAX_RETRIES", "error", err)
+		return appConfig.Order.MaxRetries
+	}
+	maxRetries, ok := settings["max_retries"].(float64)
+	if !ok {
+		slog.Warn("internal-order admin config has no max_retries, using FULFILMENT_MAX_RETRIES")
+		return appConfig.Order.MaxRetries
+	}
+	return int(maxRetries)
+}
+
+// measureRun reconciles the run's orders and sums their settlement into
+// outcome, and returns the reconciliation lines.
+func measureRun(runID string, outcome *runOutcome) ([]reconcileLine, error) {
+	lines, err := reconcile("io.run_id = ?", runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconcile run: %w", err)
+	}
+	outcome.Categories = make(map[string]int)
+	for _, line := range lines {
+		outcome.Categories[line.Category]++
+		outcome.MoneyAtRisk += line.AtRisk
+		if line.Category != categoryMatched {
+			outcome.Discrepancies++
+		}
+	}
+
+	runOrders := "order_id IN (SELECT id FROM internal_orders WHERE run_id = ?)"
+	totals, err := loadSettlementTotals(runOrders, runOrders, runID)
+	if err != nil {
+		return lines, fmt.Errorf("failed to compute run settlement summary: %w", err)
+	}
+	outcome.Settlement = totals
+	return lines, nil
+}